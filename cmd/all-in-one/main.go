@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/http-server/handlers/convert"
+	jobsHandler "bitrix-converter/internal/http-server/handlers/jobs"
+	"bitrix-converter/internal/lib/auth"
+	"bitrix-converter/internal/lib/consumer"
+	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/libreoffice"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/netguard"
+	"bitrix-converter/internal/lib/queue/backend"
+	"bitrix-converter/internal/lib/supervisor"
+	"bitrix-converter/internal/lib/tracing"
+	"bitrix-converter/internal/storage"
+	"bitrix-converter/internal/storage/bolt"
+	"bitrix-converter/internal/storage/memory"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// all-in-one runs the HTTP API and the converting workers in one process,
+// with CONVERT_QUEUE_BACKEND=memory it needs no broker at all.
+func main() {
+
+	cfg := config.MustLoad()
+
+	logger := sl.SetupLogger(cfg.Env)
+
+	logger.Info("starting bitrix converter in all-in-one mode",
+		slog.String("env", cfg.Env),
+		slog.String("queue_backend", cfg.Queue.Backend),
+	)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "converter-all-in-one")
+	if err != nil {
+		log.Fatalf("failed to setup tracing [%v]", err)
+	}
+
+	q, err := backend.New(logger, cfg)
+	if err != nil {
+		log.Fatalf("failed connect to queue [%v]", err)
+	}
+
+	if err = backend.DeclareTaskQueues(q, cfg); err != nil {
+		log.Fatalf("failed to declare queues [%v]", err)
+	}
+
+	store, err := newJobStore(cfg.Jobs)
+	if err != nil {
+		log.Fatalf("failed to open job storage [%v]", err)
+	}
+	defer store.Close()
+
+	// the tracker outlives the workers to record their last statuses
+	trackerCtx, stopTracker := context.WithCancel(context.Background())
+	defer stopTracker()
+
+	tracker := jobs.NewTracker(logger, store)
+	go tracker.Run(trackerCtx, q)
+	go tracker.Prune(trackerCtx, cfg.Jobs.Retention, cfg.Jobs.PruneInterval)
+
+	guard, err := netguard.New(cfg.NetGuard)
+	if err != nil {
+		log.Fatalf("failed to setup network guard [%v]", err)
+	}
+
+	var pool *libreoffice.Pool
+	if cfg.Convert.Libreoffice.PoolSize > 0 {
+		pool = libreoffice.New(logger, cfg.Convert.Libreoffice)
+		pool.Start()
+		defer pool.Close()
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var uploads *fileuploader.State
+	if cfg.Convert.UploadStatePath != "" {
+		uploads, err = fileuploader.OpenState(logger, cfg.Convert.UploadStatePath, cfg.Convert.UploadStateTTL)
+		if err != nil {
+			log.Fatalf("failed to open upload state [%v]", err)
+		}
+		defer uploads.Close()
+	}
+
+	c := consumer.New(logger, cfg, q, guard, pool, uploads)
+	sv := supervisor.New(logger, q, cfg.Consumer, c.HandleMessage)
+	stopped := make(chan struct{})
+	go func() {
+		sv.Run(workersCtx)
+		close(stopped)
+	}()
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(middleware.Logger)
+
+	authenticator := auth.New(cfg.Auth)
+
+	router.Route("/convert", func(r chi.Router) {
+		r.Post("/", convert.New(workersCtx, logger, q, cfg.Rabbit.DefaultQueue, cfg.Priority, tracker, authenticator))
+	})
+
+	router.Route("/jobs", func(r chi.Router) {
+		r.Use(authenticator.Middleware)
+		r.Get("/", jobsHandler.List(logger, tracker))
+		r.Get("/*", jobsHandler.Get(logger, tracker))
+	})
+
+	metricsSrv := metrics.Serve(logger, cfg.Metrics.Port)
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf("0.0.0.0:%s", cfg.APIConfig.Port),
+		Handler:      router,
+		ReadTimeout:  cfg.APIConfig.Timeout,
+		WriteTimeout: cfg.APIConfig.Timeout,
+		IdleTimeout:  cfg.APIConfig.IdleTimeout,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("failed to start http server", sl.Err(err))
+		}
+	}()
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	<-done
+
+	logger.Info("receive a shutdown signal")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = srv.Shutdown(ctx); err != nil {
+		logger.Error("failed to graceful stop http server", sl.Err(err))
+	}
+
+	if err = metricsSrv.Shutdown(ctx); err != nil {
+		logger.Error("failed to stop metrics server", sl.Err(err))
+	}
+
+	logger.Info("cancel, wait consumer")
+	stopWorkers()
+
+	select {
+	case <-stopped:
+		logger.Info("graceful shutdown")
+	case <-time.After(5 * time.Minute):
+		logger.Info("shutdown before 5 minutes timeout")
+	}
+
+	stopTracker()
+
+	if err = q.Close(); err != nil {
+		logger.Error("failed to close queue connection", sl.Err(err))
+	}
+
+	if err = shutdownTracing(context.Background()); err != nil {
+		logger.Error("failed to flush traces", sl.Err(err))
+	}
+}
+
+func newJobStore(cfg config.JobsConfig) (storage.Store[jobs.Job], error) {
+	switch cfg.Storage {
+	case "memory":
+		return memory.New(), nil
+	case "bolt":
+		return bolt.New(cfg.StoragePath)
+	default:
+		return nil, fmt.Errorf("unknown job storage [%s]", cfg.Storage)
+	}
+}
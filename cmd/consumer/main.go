@@ -2,111 +2,83 @@ package main
 
 import (
 	"bitrix-converter/internal/config"
-	"bitrix-converter/internal/lib/command"
+	"bitrix-converter/internal/lib/consumer"
 	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/libreoffice"
 	"bitrix-converter/internal/lib/logger/sl"
-	"bitrix-converter/internal/lib/rabbitmq"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/netguard"
+	"bitrix-converter/internal/lib/queue/backend"
+	"bitrix-converter/internal/lib/supervisor"
+	"bitrix-converter/internal/lib/tracing"
 	"context"
-	"encoding/json"
-	"fmt"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"log"
-	"log/slog"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 )
 
-const (
-	mainPreviewQueue       = "main_preview"
-	documentGeneratorQueue = "documentgenerator_create"
-)
-
-var (
-	queues = []string{
-		mainPreviewQueue,
-		documentGeneratorQueue,
-	}
-)
-
 func main() {
 
 	cfg := config.MustLoad()
 
 	logger := sl.SetupLogger(cfg.Env)
 
-	rabbit := rabbitmq.New(logger, cfg.Rabbit)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "converter-consumer")
+	if err != nil {
+		log.Fatalf("failed to setup tracing %v", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("failed to flush traces", sl.Err(err))
+		}
+	}()
+
+	guard, err := netguard.New(cfg.NetGuard)
+	if err != nil {
+		log.Fatalf("failed to setup network guard %v", err)
+	}
 
-	conErr := rabbit.Connect()
-	if conErr != nil {
-		log.Fatalf("failed connect to RabbitMQ with start %v", conErr)
+	var pool *libreoffice.Pool
+	if cfg.Convert.Libreoffice.PoolSize > 0 {
+		pool = libreoffice.New(logger, cfg.Convert.Libreoffice)
+		pool.Start()
+		defer pool.Close()
 	}
 
-	go rabbit.Reconnect()
+	if cfg.Queue.Backend == backend.Memory {
+		log.Fatalf("memory queue backend works only in all-in-one mode")
+	}
 
-	cancelCtx, cancel := context.WithCancel(context.Background())
-	wg := &sync.WaitGroup{}
-	for i := 1; i <= 3; i++ {
-		for _, queue := range queues {
-
-			go func() {
-				uniqId := fmt.Sprintf("%s_%d", queue, i)
-				logger.Info("start consumer", slog.String("queue", queue))
-				wg.Add(1)
-			done:
-				for {
-					time.Sleep(10 * time.Second)
-					ch, err := rabbit.Channel()
-					if err != nil {
-						logger.Error("failed to open channel. Retry", slog.String("queue", queue), sl.Err(err))
-						continue
-					}
-					defer ch.Close()
-
-					err = rabbit.InitQueue(ch, queue)
-
-					if err != nil {
-						logger.Error("failed init queue. Retry", slog.String("queue", queue), sl.Err(err))
-						continue
-					}
-
-					logger.Info("success init queue", slog.String("queue", queue))
-					msgs, err := rabbit.Consume(ch, queue)
-
-					if err != nil {
-						logger.Error("failed consume. Retry", slog.String("queue", queue), sl.Err(err))
-						continue
-					}
-
-					logger.Info("success consume. Waiting messages", slog.String("queue", queue))
-				closed:
-					for {
-						select {
-						case <-cancelCtx.Done():
-							break done
-						default:
-						}
-						select {
-						case d, ok := <-msgs:
-							if !ok {
-								logger.Info("channel closed", slog.String("queue", queue))
-								break closed
-							}
-							handleMessage(d, logger, cfg, uniqId)
-						default:
-						}
-						time.Sleep(1 * time.Second)
-					}
-				}
-				wg.Done()
-			}()
+	q, err := backend.New(logger, cfg)
+	if err != nil {
+		log.Fatalf("failed connect to queue with start %v", err)
+	}
 
+	metricsSrv := metrics.Serve(logger, cfg.Metrics.Port)
+
+	var uploads *fileuploader.State
+	if cfg.Convert.UploadStatePath != "" {
+		uploads, err = fileuploader.OpenState(logger, cfg.Convert.UploadStatePath, cfg.Convert.UploadStateTTL)
+		if err != nil {
+			log.Fatalf("failed to open upload state %v", err)
 		}
+		defer uploads.Close()
 	}
+
+	c := consumer.New(logger, cfg, q, guard, pool, uploads)
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	sv := supervisor.New(logger, q, cfg.Consumer, c.HandleMessage)
+	stopped := make(chan struct{})
+	go func() {
+		sv.Run(cancelCtx)
+		close(stopped)
+	}()
+
 	waitCh := make(chan struct{})
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGKILL)
 
 	<-ch
@@ -114,7 +86,7 @@ func main() {
 	go func() {
 		logger.Info("cancel, wait consumer")
 		cancel()
-		wg.Wait()
+		<-stopped
 		close(waitCh)
 	}()
 
@@ -125,50 +97,15 @@ func main() {
 		logger.Info("shutdown before 5 minutes timeout")
 	}
 
-}
-
-func handleMessage(d amqp.Delivery, log *slog.Logger, cfg *config.Config, uniqId string) {
-	const op = "consumer.handleMessage"
-
-	task := command.ConvertTask{}
-	queue := d.RoutingKey
-
-	err := json.Unmarshal(d.Body, &task)
-	if err != nil {
-		log.Error("failed to parse body messages", slog.String("queue", queue), sl.Err(err))
-		_ = d.Reject(false)
-		return
+	if err = q.Close(); err != nil {
+		logger.Error("failed to close queue connection", sl.Err(err))
 	}
 
-	log = log.With(
-		slog.String("op", op),
-		slog.String("request_id", task.RequestID),
-	)
-
-	uploader := fileuploader.New(task.BackUrl)
-	var cmd command.Command
-
-	switch task.Command {
-	case "Bitrix\\TransformerController\\Document":
-		cmd = command.NewDocumentCommand(task, log, *uploader, cfg.Convert, uniqId)
-	case "Bitrix\\TransformerController\\Video":
-		cmd = command.NewVideoCommand(task, log, *uploader, cfg.Convert)
-	default:
-		log.Error("failed to get command",
-			slog.String("queue", queue),
-			slog.String("command", task.Command))
-		_ = d.Reject(false)
-		return
-	}
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
 
-	err = cmd.Execute()
-	if err != nil {
-		log.Error("failed to exec command",
-			slog.String("queue", queue),
-			slog.String("command", task.Command),
-			sl.Err(err))
-      _ = d.Reject(false)
-      return;
+	if err = metricsSrv.Shutdown(ctx); err != nil {
+		logger.Error("failed to stop metrics server", sl.Err(err))
 	}
-	_ = d.Ack(false)
+
 }
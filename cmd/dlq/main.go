@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/command"
+	"bitrix-converter/internal/lib/rabbitmq"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const deadSuffix = "_dead"
+
+type options struct {
+	queue   string
+	host    string
+	command string
+	format  string
+	ids     []string
+	all     bool
+	replay  bool
+	dryRun  bool
+	limit   int
+}
+
+type message struct {
+	delivery amqp.Delivery
+	task     command.ConvertTask
+	parseErr error
+}
+
+func main() {
+	opts := parseFlags()
+
+	cfg := config.MustLoad()
+
+	if opts.queue == "" {
+		opts.queue = cfg.Rabbit.DefaultQueue
+	}
+	if opts.replay && len(opts.ids) == 0 && !opts.all {
+		log.Fatal("-replay needs -ids or -all")
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	rabbit := rabbitmq.New(logger, cfg.Rabbit, cfg.Queue.MaxPriority)
+	if err := rabbit.Connect(); err != nil {
+		log.Fatalf("failed connect to RabbitMQ %v", err)
+	}
+	defer rabbit.Close()
+
+	ch, err := rabbit.Channel()
+	if err != nil {
+		log.Fatalf("failed to open channel %v", err)
+	}
+	// messages that were not acked go back to the dead letter queue
+	defer ch.Close()
+
+	deadQueue := opts.queue + deadSuffix
+
+	messages, err := fetch(ch, deadQueue, opts.limit)
+	if err != nil {
+		log.Fatalf("failed to read [%s] %v", deadQueue, err)
+	}
+
+	var matched []message
+	for _, m := range messages {
+		if opts.match(m) {
+			matched = append(matched, m)
+		}
+	}
+
+	printMessages(matched)
+	fmt.Fprintf(os.Stderr, "%d of %d messages in [%s] match the filters\n", len(matched), len(messages), deadQueue)
+
+	if !opts.replay {
+		return
+	}
+
+	replayed, failed, err := replay(rabbit, matched, opts)
+
+	if opts.dryRun {
+		fmt.Fprintf(os.Stderr, "dry run: %d messages would be replayed\n", replayed)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d messages replayed, %d failed and left in [%s]\n", replayed, failed, deadQueue)
+	if err != nil {
+		log.Fatalf("replay interrupted %v", err)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// replay republishes the messages selected by the options. A message is removed from the dead letter
+// queue only after the broker confirmed its copy, one that could not be republished stays there.
+// An error stops the replay, the counts tell what was done before it.
+func replay(rabbit *rabbitmq.Rabbit, messages []message, opts options) (replayed int, failed int, err error) {
+	for _, m := range messages {
+		if len(opts.ids) > 0 && !slices.Contains(opts.ids, m.task.RequestID) {
+			continue
+		}
+		target := originalQueue(m.delivery, opts.queue)
+
+		if opts.dryRun {
+			fmt.Fprintf(os.Stderr, "dry run: would replay [%s] to [%s]\n", m.task.RequestID, target)
+			replayed++
+			continue
+		}
+
+		if err = republish(rabbit, m.delivery, target); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to replay [%s] to [%s]: %v\n", m.task.RequestID, target, err)
+			failed++
+			continue
+		}
+		if err = m.delivery.Ack(false); err != nil {
+			// the copy is already in the queue, the dead message comes back when the channel is closed
+			return replayed, failed, fmt.Errorf("failed to ack replayed [%s]: [%w]", m.task.RequestID, err)
+		}
+		replayed++
+	}
+	return replayed, failed, nil
+}
+
+func parseFlags() options {
+	var opts options
+	var ids string
+
+	flag.StringVar(&opts.queue, "queue", "", "source queue, its dead letter queue is read (default RABBITMQ_DEFAULT_QUEUE)")
+	flag.StringVar(&opts.host, "host", "", "only tasks of the portal host (back_url)")
+	flag.StringVar(&opts.command, "command", "", "only tasks of the command, e.g. Document or Video")
+	flag.StringVar(&opts.format, "format", "", "only tasks requesting the format")
+	flag.StringVar(&ids, "ids", "", "comma separated job ids to replay")
+	flag.BoolVar(&opts.all, "all", false, "replay every message matching the filters")
+	flag.BoolVar(&opts.replay, "replay", false, "republish messages to the original queue")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "show what would be replayed without changing the queues")
+	flag.IntVar(&opts.limit, "limit", 0, "read at most this many messages (0 - all)")
+	flag.Parse()
+
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			opts.ids = append(opts.ids, id)
+		}
+	}
+	return opts
+}
+
+// fetch takes messages from the queue without acknowledging them, so none of them is returned twice
+// and all of them are requeued when the channel is closed.
+func fetch(ch *amqp.Channel, queue string, limit int) ([]message, error) {
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	count := q.Messages
+	if limit > 0 {
+		count = min(count, limit)
+	}
+
+	var messages []message
+	for len(messages) < count {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		m := message{delivery: d}
+		m.parseErr = json.Unmarshal(d.Body, &m.task)
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+func (o options) match(m message) bool {
+	if m.parseErr != nil {
+		// broken messages are shown only without filters and are never replayed
+		return o.host == "" && o.command == "" && o.format == "" && !o.replay
+	}
+	if o.host != "" && !strings.EqualFold(host(m.task.BackUrl), o.host) {
+		return false
+	}
+	if o.command != "" && !strings.Contains(strings.ToLower(m.task.Command), strings.ToLower(o.command)) {
+		return false
+	}
+	if o.format != "" && !slices.Contains(m.task.Formats, o.format) {
+		return false
+	}
+	return true
+}
+
+func printMessages(messages []message) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB ID\tHOST\tCOMMAND\tFORMATS\tRETRIES\tDEATHS")
+
+	for _, m := range messages {
+		if m.parseErr != nil {
+			fmt.Fprintf(w, "-\t-\t-\t-\t-\tunreadable body: %v\n", m.parseErr)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			m.task.RequestID,
+			host(m.task.BackUrl),
+			m.task.Command,
+			strings.Join(m.task.Formats, ","),
+			rabbitmq.RetryCount(m.delivery.Headers),
+			strings.Join(deaths(m.delivery.Headers), "; "),
+		)
+	}
+	_ = w.Flush()
+}
+
+// deaths describes the x-death entries added by the broker each time the message was dead-lettered.
+func deaths(headers amqp.Table) []string {
+	var res []string
+	for _, table := range deathTables(headers) {
+		reason, _ := table["reason"].(string)
+		queue, _ := table["queue"].(string)
+		count, _ := table["count"].(int64)
+
+		death := fmt.Sprintf("%s from %s x%d", reason, queue, count)
+		if t, ok := table["time"].(time.Time); ok {
+			death += " at " + t.Format(time.DateTime)
+		}
+		res = append(res, death)
+	}
+	return res
+}
+
+// originalQueue is the queue the message was rejected from, retry queues are skipped.
+func originalQueue(d amqp.Delivery, fallback string) string {
+	if queue, ok := d.Headers["x-first-death-queue"].(string); ok && queue != "" && !strings.Contains(queue, "_retry_") {
+		return queue
+	}
+	for _, entry := range deathTables(d.Headers) {
+		if queue, _ := entry["queue"].(string); queue != "" && !strings.Contains(queue, "_retry_") {
+			return queue
+		}
+	}
+	return fallback
+}
+
+func deathTables(headers amqp.Table) []amqp.Table {
+	entries, _ := headers["x-death"].([]interface{})
+
+	var res []amqp.Table
+	for _, entry := range entries {
+		if table, ok := entry.(amqp.Table); ok {
+			res = append(res, table)
+		}
+	}
+	return res
+}
+
+// republish sends the message back with a fresh retry budget and waits for the broker confirm.
+func republish(rabbit *rabbitmq.Rabbit, d amqp.Delivery, queue string) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		if k == rabbitmq.RetryCountHeader || k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		headers[k] = v
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rabbit.PublishMessage(ctx, queue, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Priority:     d.Priority,
+		Body:         d.Body,
+	})
+}
+
+func host(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/auth"
 	"bitrix-converter/internal/lib/logger/sl"
-	"bitrix-converter/internal/lib/rabbitmq"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/queue/backend"
+	"bitrix-converter/internal/lib/tracing"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"log"
 
 	"bitrix-converter/internal/http-server/handlers/convert"
+	jobsHandler "bitrix-converter/internal/http-server/handlers/jobs"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/storage"
+	"bitrix-converter/internal/storage/bolt"
+	"bitrix-converter/internal/storage/memory"
 	"log/slog"
 	"net/http"
 	"os"
@@ -29,25 +38,61 @@ func main() {
 		slog.String("env", cfg.Env),
 	)
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "converter-producer")
+	if err != nil {
+		log.Fatalf("failed to setup tracing [%v]", err)
+		return
+	}
+
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
 
-	ctx := context.WithoutCancel(context.Background())
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	if cfg.Queue.Backend == backend.Memory {
+		log.Fatalf("memory queue backend works only in all-in-one mode")
+		return
+	}
+
+	q, err := backend.New(logger, cfg)
+	if err != nil {
+		log.Fatalf("failed connect to queue with start producer [%v]", err)
+		return
+	}
 
-	rabbit := rabbitmq.New(logger, cfg.Rabbit)
-	err := rabbit.Connect()
+	// tasks for a queue that is not declared are rejected by the broker,
+	// so the known queues are declared before consumers start
+	if err = backend.DeclareTaskQueues(q, cfg); err != nil {
+		logger.Error("failed to declare queues", sl.Err(err))
+	}
+
+	store, err := newJobStore(cfg.Jobs)
 	if err != nil {
-		log.Fatalf("failed connect to RabbitMQ with start producer [%v]", err)
+		log.Fatalf("failed to open job storage [%v]", err)
 		return
 	}
+	defer store.Close()
+
+	tracker := jobs.NewTracker(logger, store)
+	go tracker.Run(ctx, q)
+	go tracker.Prune(ctx, cfg.Jobs.Retention, cfg.Jobs.PruneInterval)
 
-	go rabbit.Reconnect()
+	authenticator := auth.New(cfg.Auth)
 
 	router.Route("/convert", func(r chi.Router) {
-		r.Post("/", convert.New(ctx, logger, rabbit))
+		r.Post("/", convert.New(ctx, logger, q, cfg.Rabbit.DefaultQueue, cfg.Priority, tracker, authenticator))
 	})
 
+	router.Route("/jobs", func(r chi.Router) {
+		r.Use(authenticator.Middleware)
+		r.Get("/", jobsHandler.List(logger, tracker))
+		r.Get("/*", jobsHandler.Get(logger, tracker))
+	})
+
+	metricsSrv := metrics.Serve(logger, cfg.Metrics.Port)
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
@@ -60,7 +105,7 @@ func main() {
 	}
 
 	go func() {
-		if err = srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("failed to start producer", sl.Err(err))
 		}
 	}()
@@ -71,6 +116,8 @@ func main() {
 
 	logger.Info("graceful stopping producer")
 
+	stop()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
@@ -79,6 +126,29 @@ func main() {
 		return
 	}
 
+	if err = metricsSrv.Shutdown(ctx); err != nil {
+		logger.Error("failed to stop metrics server", sl.Err(err))
+	}
+
+	if err = shutdownTracing(ctx); err != nil {
+		logger.Error("failed to flush traces", sl.Err(err))
+	}
+
+	if err = q.Close(); err != nil {
+		logger.Error("failed to close queue connection", sl.Err(err))
+	}
+
 	logger.Info("producer is stopped")
 
 }
+
+func newJobStore(cfg config.JobsConfig) (storage.Store[jobs.Job], error) {
+	switch cfg.Storage {
+	case "memory":
+		return memory.New(), nil
+	case "bolt":
+		return bolt.New(cfg.StoragePath)
+	default:
+		return nil, fmt.Errorf("unknown job storage [%s]", cfg.Storage)
+	}
+}
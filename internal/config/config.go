@@ -9,23 +9,136 @@ import (
 type Config struct {
 	Env       string `env:"CONVERT_ENV"`
 	APIConfig APIConfig
+	Queue     QueueConfig
 	Rabbit    RabbitConfig
+	Redis     RedisConfig
 	Convert   ConvertConfig
+	Jobs      JobsConfig
+	Metrics   MetricsConfig
+	Tracing   TracingConfig
+	Auth      AuthConfig
+	NetGuard  NetGuardConfig
+	Consumer  ConsumerConfig
+	Retry     RetryConfig
+	Priority  PriorityConfig
 }
 
 type ConvertConfig struct {
-	SuccessDir      string `env:"CONVERT_SUCCESS_DIRECTORY"`
-	DownloadDir     string `env:"CONVERT_DOWNLOAD_DIRECTORY"`
-	MaxVideoSize    int64  `env:"CONVERT_MAX_VIDEO_SIZE"`
-	MaxDocumentSize int64  `env:"CONVERT_MAX_DOCUMENT_SIZE"`
+	Libreoffice       LibreofficeConfig
+	SuccessDir        string        `env:"CONVERT_SUCCESS_DIRECTORY"`
+	DownloadDir       string        `env:"CONVERT_DOWNLOAD_DIRECTORY"`
+	MaxVideoSize      int64         `env:"CONVERT_MAX_VIDEO_SIZE"`
+	MaxDocumentSize   int64         `env:"CONVERT_MAX_DOCUMENT_SIZE"`
+	MaxTextSize       int64         `env:"CONVERT_MAX_TEXT_SIZE" env-default:"1048576"`
+	UploadParallelism int           `env:"CONVERT_UPLOAD_PARALLELISM" env-default:"3"`
+	UploadStatePath   string        `env:"CONVERT_UPLOAD_STATE_PATH" env-default:"/app/upload/uploads.db"`
+	UploadStateTTL    time.Duration `env:"CONVERT_UPLOAD_STATE_TTL" env-default:"24h"`
+	DocumentTimeout   time.Duration `env:"CONVERT_DOCUMENT_TIMEOUT" env-default:"5m"`
+	ImageTimeout      time.Duration `env:"CONVERT_IMAGE_TIMEOUT" env-default:"5m"`
+	VideoTimeout      time.Duration `env:"CONVERT_VIDEO_TIMEOUT" env-default:"30m"`
 }
 
+type ConsumerConfig struct {
+	Workers        map[string]int `env:"CONVERT_CONSUMER_WORKERS" env-default:"main_preview:3,documentgenerator_create:3"`
+	MinWorkers     map[string]int `env:"CONVERT_CONSUMER_MIN_WORKERS" env-default:"main_preview:1,documentgenerator_create:1"`
+	Prefetch       map[string]int `env:"CONVERT_CONSUMER_PREFETCH" env-default:"main_preview:1,documentgenerator_create:1"`
+	ScaleInterval  time.Duration  `env:"CONVERT_CONSUMER_SCALE_INTERVAL" env-default:"30s"`
+	ReconnectDelay time.Duration  `env:"CONVERT_CONSUMER_RECONNECT_DELAY" env-default:"5s"`
+	MaxLoad        float64        `env:"CONVERT_CONSUMER_MAX_LOAD" env-default:"0.9"`
+	MinFreeMemory  int64          `env:"CONVERT_CONSUMER_MIN_FREE_MEMORY" env-default:"536870912"`
+}
+
+// RetryConfig sets retries per error class (download, convert, upload).
+// MaxAttempts counts the first delivery, classes without attempts are not retried.
+type RetryConfig struct {
+	MaxAttempts map[string]int           `env:"CONVERT_RETRY_MAX_ATTEMPTS" env-default:"download:5,convert:2,upload:5"`
+	Backoff     map[string]time.Duration `env:"CONVERT_RETRY_BACKOFF" env-default:"download:30s,convert:1m,upload:30s"`
+	MaxBackoff  time.Duration            `env:"CONVERT_RETRY_MAX_BACKOFF" env-default:"1h"`
+}
+
+type LibreofficeConfig struct {
+	PoolSize       int           `env:"CONVERT_LIBREOFFICE_POOL_SIZE" env-default:"0"`
+	BasePort       int           `env:"CONVERT_LIBREOFFICE_POOL_PORT" env-default:"2003"`
+	MaxConversions int           `env:"CONVERT_LIBREOFFICE_MAX_CONVERSIONS" env-default:"200"`
+	StartTimeout   time.Duration `env:"CONVERT_LIBREOFFICE_START_TIMEOUT" env-default:"60s"`
+}
+
+// AuthConfig enables the checks of API requests. A signature is accepted for SignatureTTL
+// around its timestamp, so a captured request cannot be replayed later.
+type AuthConfig struct {
+	Secret         string        `env:"CONVERT_AUTH_SECRET"`
+	SignatureTTL   time.Duration `env:"CONVERT_AUTH_SIGNATURE_TTL" env-default:"5m"`
+	APIKeys        []string      `env:"CONVERT_AUTH_API_KEYS" env-separator:","`
+	AllowedDomains []string      `env:"CONVERT_AUTH_ALLOWED_DOMAINS" env-separator:","`
+}
+
+type NetGuardConfig struct {
+	Enabled         bool     `env:"CONVERT_SSRF_PROTECTION" env-default:"true"`
+	AllowedNetworks []string `env:"CONVERT_SSRF_ALLOWED_NETWORKS" env-separator:","`
+	AllowedHosts    []string `env:"CONVERT_SSRF_ALLOWED_HOSTS" env-separator:","`
+}
+
+type JobsConfig struct {
+	Storage       string        `env:"CONVERT_JOBS_STORAGE" env-default:"bolt"`
+	StoragePath   string        `env:"CONVERT_JOBS_STORAGE_PATH" env-default:"/app/data/jobs.db"`
+	Retention     time.Duration `env:"CONVERT_JOBS_RETENTION" env-default:"168h"`
+	PruneInterval time.Duration `env:"CONVERT_JOBS_PRUNE_INTERVAL" env-default:"1h"`
+}
+
+type MetricsConfig struct {
+	Port string `env:"CONVERT_METRICS_PORT" env-default:"9100"`
+}
+
+type TracingConfig struct {
+	Endpoint    string  `env:"CONVERT_TRACING_ENDPOINT"`
+	Insecure    bool    `env:"CONVERT_TRACING_INSECURE" env-default:"true"`
+	SampleRatio float64 `env:"CONVERT_TRACING_SAMPLE_RATIO" env-default:"1"`
+}
+
+// QueueConfig selects the queue backend. Task queues accept priorities from 0 to MaxPriority,
+// 0 disables priorities.
+type QueueConfig struct {
+	Backend     string `env:"CONVERT_QUEUE_BACKEND" env-default:"rabbitmq"`
+	MaxPriority uint8  `env:"CONVERT_QUEUE_MAX_PRIORITY" env-default:"0"`
+}
+
+// PriorityConfig derives the priority of a task: params[priority] of the request wins, then the command,
+// then the queue, then Default. A file larger than LargeFileSize gets at most LargeFilePriority.
+type PriorityConfig struct {
+	Default           int            `env:"CONVERT_PRIORITY_DEFAULT" env-default:"2"`
+	Commands          map[string]int `env:"CONVERT_PRIORITY_COMMANDS"`
+	Queues            map[string]int `env:"CONVERT_PRIORITY_QUEUES" env-default:"documentgenerator_create:4"`
+	LargeFileSize     int64          `env:"CONVERT_PRIORITY_LARGE_FILE_SIZE" env-default:"104857600"`
+	LargeFilePriority int            `env:"CONVERT_PRIORITY_LARGE_FILE" env-default:"0"`
+}
+
+// RedisConfig describes the Redis Streams backend. An entry left pending by a consumer for ClaimIdle
+// is taken over by another one, a consumer renews the entries it is still processing. An entry delivered
+// more than MaxDeliveries times is not claimed again, it goes to the dead-letter stream.
+type RedisConfig struct {
+	URL           string        `env:"REDIS_URL" env-default:"redis://redis:6379/0"`
+	KeyPrefix     string        `env:"REDIS_KEY_PREFIX" env-default:"converter:"`
+	Group         string        `env:"REDIS_GROUP" env-default:"converter"`
+	ClaimIdle     time.Duration `env:"REDIS_CLAIM_IDLE" env-default:"1m"`
+	MaxDeliveries int64         `env:"REDIS_MAX_DELIVERIES" env-default:"5"`
+}
+
+// RabbitConfig describes the broker connection. URL replaces User, Password, Hosts, Port and Vhost,
+// several hosts or URLs are separated by commas and tried in turn.
 type RabbitConfig struct {
-	User         string `env:"RABBITMQ_USER" env-required:"true"`
-	Password     string `env:"RABBITMQ_PASSWORD"`
-	Host         string `env:"RABBITMQ_HOST" env-required:"true"`
-	Port         string `env:"RABBITMQ_PORT" env-required:"true"`
-	DefaultQueue string `env:"RABBITMQ_DEFAULT_QUEUE" env-required:"true"`
+	URL            []string      `env:"RABBITMQ_URL" env-separator:","`
+	User           string        `env:"RABBITMQ_USER"`
+	Password       string        `env:"RABBITMQ_PASSWORD"`
+	Hosts          []string      `env:"RABBITMQ_HOST" env-separator:","`
+	Port           string        `env:"RABBITMQ_PORT" env-default:"5672"`
+	Vhost          string        `env:"RABBITMQ_VHOST"`
+	DefaultQueue   string        `env:"RABBITMQ_DEFAULT_QUEUE" env-required:"true"`
+	TLS            bool          `env:"RABBITMQ_TLS"`
+	CACert         string        `env:"RABBITMQ_CA_CERT"`
+	ClientCert     string        `env:"RABBITMQ_CLIENT_CERT"`
+	ClientKey      string        `env:"RABBITMQ_CLIENT_KEY"`
+	ConnectionName string        `env:"RABBITMQ_CONNECTION_NAME" env-default:"bitrix-converter"`
+	Heartbeat      time.Duration `env:"RABBITMQ_HEARTBEAT" env-default:"10s"`
 }
 
 type APIConfig struct {
@@ -1,15 +1,24 @@
 package convert
 
 import (
+	"bitrix-converter/internal/config"
 	resp "bitrix-converter/internal/lib/api/response"
+	"bitrix-converter/internal/lib/auth"
 	"bitrix-converter/internal/lib/command"
+	"bitrix-converter/internal/lib/jobs"
 	"bitrix-converter/internal/lib/logger/sl"
-	"bitrix-converter/internal/lib/rabbitmq"
+	"bitrix-converter/internal/lib/queue"
+	"bitrix-converter/internal/lib/tracing"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -17,38 +26,60 @@ import (
 	"strconv"
 )
 
-func New(ctx context.Context, log *slog.Logger, rabbit *rabbitmq.Rabbit) http.HandlerFunc {
+func New(ctx context.Context, log *slog.Logger, publisher queue.Publisher, defaultQueue string, priorities config.PriorityConfig, tracker *jobs.Tracker, authenticator *auth.Authenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		const op = "handlers.convert.New"
 
 		reqId := middleware.GetReqID(r.Context())
 
-		log = log.With(
+		reqCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		reqCtx, span := tracing.Start(reqCtx, op,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("job_id", reqId)),
+		)
+		defer span.End()
+
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", reqId),
 		)
 
-		err := r.ParseForm()
+		err := authenticator.VerifyRequest(w, r)
+		if err != nil {
+			rejectRequest(w, r, log, err)
+			return
+		}
+
+		err = r.ParseForm()
 
 		if err != nil {
 			log.Error("failed to decode request body", sl.Err(err))
-			render.JSON(w, r, resp.Error("failed to decode request body", 152))
+			render.JSON(w, r, resp.Error("failed to decode request body", resp.CodeInvalidRequest))
+			return
 		}
 
 		task, err := prepareOptions(r.Form, reqId)
 
 		if err != nil {
 			log.Error("failed to prepare options", sl.Err(err))
-			render.JSON(w, r, resp.Error("failed to parse task", 0))
+			render.JSON(w, r, resp.Error("failed to parse task", resp.CodeInvalidRequest))
+			return
+		}
+
+		err = authenticator.VerifyUrls(task.BackUrl, task.File)
+		if err != nil {
+			rejectRequest(w, r, log, err)
 			return
 		}
 
 		if task.Queue == "" {
-			task.Queue = rabbit.DefaultQueue()
+			task.Queue = defaultQueue
 			log.Warn("not found queue. Set default", slog.String("default_queue", task.Queue))
 		}
 
+		taskPriority := priority(priorities, task, r.Form)
+
 		taskMsg, err := json.Marshal(task)
 
 		if err != nil {
@@ -59,13 +90,55 @@ func New(ctx context.Context, log *slog.Logger, rabbit *rabbitmq.Rabbit) http.Ha
 			return
 		}
 
-		err = rabbit.Publish(task.Queue, taskMsg)
+		err = tracker.Create(jobs.Job{
+			ID:       task.RequestID,
+			Command:  task.Command,
+			Queue:    task.Queue,
+			File:     task.File,
+			FileId:   task.FileId,
+			FileSize: task.FileSize,
+			BackUrl:  task.BackUrl,
+			Formats:  task.Formats,
+			Priority: taskPriority,
+		})
+		if err != nil {
+			log.Error("failed to track job", sl.Err(err))
+		}
+
+		err = publisher.PublishPriority(reqCtx, task.Queue, taskMsg, taskPriority)
 		if err != nil {
-			log.Error("error publish task", slog.String("queue", task.Queue), sl.Err(err))
-			render.JSON(w, r, resp.Error("error publish task", 0))
+			span.RecordError(err)
+			log.Error("error publish task",
+				slog.String("queue", task.Queue),
+				slog.Int("priority", int(taskPriority)),
+				sl.Err(err),
+			)
+			_ = tracker.Apply(jobs.Event{
+				JobID:  task.RequestID,
+				Status: jobs.StatusFailed,
+				Error:  err.Error(),
+			})
+			if errors.Is(err, queue.ErrUnroutable) {
+				render.JSON(w, r, resp.Error("queue not found", resp.CodeQueueNotFound))
+				return
+			}
+			render.JSON(w, r, resp.Error("error publish task", resp.CodeQueueAddFail))
+			return
 		}
-		render.JSON(w, r, resp.Success())
+		// the broker has confirmed the task, it will not be lost
+		render.JSON(w, r, resp.Queued(task.RequestID))
+	}
+}
+
+func rejectRequest(w http.ResponseWriter, r *http.Request, log *slog.Logger, err error) {
+	log.Warn("request rejected", sl.Err(err))
+
+	var authErr *auth.Error
+	if errors.As(err, &authErr) {
+		render.JSON(w, r, resp.Error(authErr.Msg, authErr.Code))
+		return
 	}
+	render.JSON(w, r, resp.Error("request rejected", resp.CodeRightCheckFailed))
 }
 
 func parseFormats(form url.Values) ([]string, error) {
@@ -0,0 +1,29 @@
+package convert
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/command"
+	"net/url"
+	"strconv"
+)
+
+// priority of the task: params[priority] of the request wins, then the priority of the command,
+// then of the queue. Large files never get more than LargeFilePriority,
+// so a backlog of videos does not hold back documents someone is waiting for.
+func priority(cfg config.PriorityConfig, task command.ConvertTask, form url.Values) uint8 {
+	p := cfg.Default
+	if v, ok := cfg.Queues[task.Queue]; ok {
+		p = v
+	}
+	if v, ok := cfg.Commands[task.Command]; ok {
+		p = v
+	}
+	if v, err := strconv.Atoi(form.Get("params[priority]")); err == nil {
+		p = v
+	}
+
+	if cfg.LargeFileSize > 0 && task.FileSize > cfg.LargeFileSize {
+		p = min(p, cfg.LargeFilePriority)
+	}
+	return uint8(max(min(p, 255), 0))
+}
@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	resp "bitrix-converter/internal/lib/api/response"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/storage"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+type JobProvider interface {
+	Job(id string) (jobs.Job, error)
+	Jobs(status jobs.Status, limit int, after storage.Cursor) ([]jobs.Job, storage.Cursor, error)
+}
+
+type Response struct {
+	resp.Response
+	Job        *jobs.Job  `json:"job,omitempty"`
+	Jobs       []jobs.Job `json:"jobs,omitempty"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+var (
+	statuses = []jobs.Status{
+		jobs.StatusQueued,
+		jobs.StatusDownloading,
+		jobs.StatusConverting,
+		jobs.StatusUploading,
+		jobs.StatusRetrying,
+		jobs.StatusCompleted,
+		jobs.StatusFailed,
+	}
+)
+
+// Get returns a single job. Request ids generated by chi contain a slash,
+// so the id is taken from the wildcard part of the route.
+func Get(log *slog.Logger, provider JobProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.Get"
+
+		id := chi.URLParam(r, "*")
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("job_id", id),
+		)
+
+		job, err := provider.Job(id)
+		if errors.Is(err, storage.ErrJobNotFound) {
+			log.Info("job not found")
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, resp.Error("job not found", 0))
+			return
+		}
+		if err != nil {
+			log.Error("failed to get job", sl.Err(err))
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, resp.Error("failed to get job", 0))
+			return
+		}
+
+		render.JSON(w, r, Response{
+			Response: resp.Success(),
+			Job:      &job,
+		})
+	}
+}
+
+// List returns up to limit jobs (100 by default, at most 1000), newest first.
+// The next page is requested with the next_cursor of the response.
+func List(log *slog.Logger, provider JobProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.List"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		status := jobs.Status(r.URL.Query().Get("status"))
+
+		if status != "" && !slices.Contains(statuses, status) {
+			log.Info("unknown job status", slog.String("status", string(status)))
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, resp.Error("unknown job status", 0))
+			return
+		}
+
+		limit := defaultLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				log.Info("invalid limit", slog.String("limit", value))
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, resp.Error("invalid limit", 0))
+				return
+			}
+			limit = min(n, maxLimit)
+		}
+
+		after, err := storage.ParseCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			log.Info("invalid cursor", sl.Err(err))
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, resp.Error("invalid cursor", 0))
+			return
+		}
+
+		list, next, err := provider.Jobs(status, limit, after)
+		if err != nil {
+			log.Error("failed to get jobs", sl.Err(err))
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, resp.Error("failed to get jobs", 0))
+			return
+		}
+
+		render.JSON(w, r, Response{
+			Response:   resp.Success(),
+			Jobs:       list,
+			NextCursor: next.String(),
+		})
+	}
+}
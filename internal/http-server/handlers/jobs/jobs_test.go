@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/storage"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// provider is a JobProvider over a fixed list of jobs that records the status it was asked for.
+type provider struct {
+	jobs   []jobs.Job
+	status jobs.Status
+	calls  int
+}
+
+func (p *provider) Job(id string) (jobs.Job, error) {
+	for _, job := range p.jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return jobs.Job{}, storage.ErrJobNotFound
+}
+
+func (p *provider) Jobs(status jobs.Status, limit int, _ storage.Cursor) ([]jobs.Job, storage.Cursor, error) {
+	p.status = status
+	p.calls++
+
+	var list []jobs.Job
+	for _, job := range p.jobs {
+		if (status == "" || job.Status == status) && len(list) < limit {
+			list = append(list, job)
+		}
+	}
+	return list, storage.Cursor{}, nil
+}
+
+func TestListFiltersByStatus(t *testing.T) {
+	p := &provider{jobs: []jobs.Job{
+		{ID: "1", Status: jobs.StatusRetrying},
+		{ID: "2", Status: jobs.StatusCompleted},
+		{ID: "3", Status: jobs.StatusRetrying},
+		{ID: "4", Status: jobs.StatusFailed},
+	}}
+	handler := List(slog.New(slog.DiscardHandler), p)
+
+	tests := []struct {
+		status jobs.Status
+		ids    []string
+	}{
+		{jobs.StatusRetrying, []string{"1", "3"}},
+		{jobs.StatusCompleted, []string{"2"}},
+		{jobs.StatusFailed, []string{"4"}},
+		{jobs.StatusQueued, nil},
+		{"", []string{"1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/jobs?status="+string(tt.status), nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if p.status != tt.status {
+				t.Fatalf("provider asked for status %q, want %q", p.status, tt.status)
+			}
+
+			var res Response
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if len(res.Jobs) != len(tt.ids) {
+				t.Fatalf("got %d jobs, want %v", len(res.Jobs), tt.ids)
+			}
+			for i, job := range res.Jobs {
+				if job.ID != tt.ids[i] {
+					t.Errorf("job %d is %q, want %q", i, job.ID, tt.ids[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListRejectsUnknownStatus(t *testing.T) {
+	p := &provider{}
+	w := httptest.NewRecorder()
+	List(slog.New(slog.DiscardHandler), p)(w, httptest.NewRequest("GET", "/jobs?status=paused", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if p.calls != 0 {
+		t.Fatal("provider was asked for jobs of an unknown status")
+	}
+}
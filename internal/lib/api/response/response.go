@@ -1,8 +1,28 @@
 package response
 
+// Error codes of the Bitrix24 transformer module. CodeInvalidRequest is not one of them,
+// it marks a request the converter could not read.
+const (
+	CodeInvalidRequest        = 0
+	CodeDownloadStatus        = 100
+	CodeDownloadType          = 101
+	CodeDownloadSize          = 102
+	CodeBannedDomain          = 103
+	CodeQueueAddFail          = 151
+	CodeQueueNotFound         = 152
+	CodeRightCheckFailed      = 154
+	CodeDownload              = 200
+	CodeTransformation        = 300
+	CodeUnsupportedFormat     = 301
+	CodeCommandNotFound       = 302
+	CodeTransformationTimeout = 304
+	CodeUpload                = 400
+)
+
 type Response struct {
 	Success bool    `json:"success"`
 	Result  *Result `json:"result,omitempty"`
+	JobID   string  `json:"job_id,omitempty"`
 }
 
 type Result struct {
@@ -22,3 +42,10 @@ func Success() Response {
 		Success: true,
 	}
 }
+
+func Queued(jobId string) Response {
+	return Response{
+		Success: true,
+		JobID:   jobId,
+	}
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bitrix-converter/internal/config"
+	resp "bitrix-converter/internal/lib/api/response"
+	"bitrix-converter/internal/lib/util"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Timestamp"
+
+	maxBodySize = 1 << 20
+)
+
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Authenticator checks requests to /convert and /jobs. Every check is enabled only when it is configured.
+type Authenticator struct {
+	secret  []byte
+	ttl     time.Duration
+	keys    [][]byte
+	domains []string
+}
+
+func New(cfg config.AuthConfig) *Authenticator {
+	a := &Authenticator{
+		secret: []byte(cfg.Secret),
+		ttl:    cfg.SignatureTTL,
+	}
+	for _, key := range cfg.APIKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			a.keys = append(a.keys, []byte(key))
+		}
+	}
+	for _, domain := range cfg.AllowedDomains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			a.domains = append(a.domains, domain)
+		}
+	}
+	return a
+}
+
+// VerifyRequest checks the bearer API key and the HMAC-SHA256 signature of
+// "<timestamp>\n<method>\n<request uri>\n<body>", where the timestamp is the unix time of X-Timestamp
+// and must be within the signature TTL of now, and the request uri is the path with the query as sent.
+// The body is restored, so the form can be parsed afterwards.
+func (a *Authenticator) VerifyRequest(w http.ResponseWriter, r *http.Request) error {
+	if len(a.keys) > 0 && !a.validKey(r.Header.Get("Authorization")) {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: "invalid api key"}
+	}
+
+	if len(a.secret) == 0 {
+		return nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: fmt.Sprintf("failed to read request body: %s", err)}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: "missing or malformed signature"}
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: "missing or malformed timestamp"}
+	}
+	if a.ttl > 0 && time.Since(time.Unix(signedAt, 0)).Abs() > a.ttl {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: "signature expired"}
+	}
+
+	if !hmac.Equal(signature, sign(a.secret, timestamp, r.Method, r.URL.RequestURI(), body)) {
+		return &Error{Code: resp.CodeRightCheckFailed, Msg: "invalid signature"}
+	}
+	return nil
+}
+
+// Middleware protects routes without a form, such as /jobs, with the same API key and signature checks.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.VerifyRequest(w, r); err != nil {
+			msg, code := "request rejected", resp.CodeRightCheckFailed
+			var authErr *Error
+			if errors.As(err, &authErr) {
+				msg, code = authErr.Msg, authErr.Code
+			}
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, resp.Error(msg, code))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sign computes the signature of the request, the method, the uri and the body are signed
+// so a captured signature cannot be replayed against another route or query.
+func sign(secret []byte, timestamp string, method string, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + uri + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// VerifyUrls checks that the callback and the source file belong to allowed portal domains.
+func (a *Authenticator) VerifyUrls(backUrl string, file string) error {
+	if len(a.domains) == 0 {
+		return nil
+	}
+	if !a.allowedUrl(backUrl) {
+		return &Error{Code: resp.CodeBannedDomain, Msg: "back_url domain is not allowed"}
+	}
+	if !a.allowedUrl(file) {
+		return &Error{Code: resp.CodeBannedDomain, Msg: "file domain is not allowed"}
+	}
+	return nil
+}
+
+func (a *Authenticator) validKey(header string) bool {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return false
+	}
+	valid := 0
+	for _, key := range a.keys {
+		valid |= subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), key)
+	}
+	return valid == 1
+}
+
+// allowedUrl matches the host exactly or as a subdomain of an allowed domain.
+func (a *Authenticator) allowedUrl(rawUrl string) bool {
+	u, err := url.Parse(util.FixInvalidUrlEscapes(rawUrl))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range a.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"bitrix-converter/internal/config"
+	resp "bitrix-converter/internal/lib/api/response"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const secret = "secret"
+
+// signed builds a request signed for method, uri and body at signedAt.
+func signed(method string, uri string, body string, signedAt time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(sign([]byte(secret), timestamp, method, uri, []byte(body))))
+	return r
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	a := New(config.AuthConfig{Secret: secret, SignatureTTL: 5 * time.Minute})
+	form := "params[file]=https://b24.example.com/a.docx"
+
+	// the request is signed for method and uri, then sent with the sent* fields that are set
+	tests := []struct {
+		name       string
+		method     string
+		uri        string
+		age        time.Duration
+		sentMethod string
+		sentUri    string
+		sentBody   string
+		unsigned   bool
+		valid      bool
+	}{
+		{name: "valid convert", method: "POST", uri: "/convert", valid: true},
+		{name: "valid jobs query", method: "GET", uri: "/jobs?status=failed", valid: true},
+		{name: "within ttl", method: "POST", uri: "/convert", age: 4 * time.Minute, valid: true},
+		{name: "expired", method: "POST", uri: "/convert", age: 6 * time.Minute},
+		{name: "from the future", method: "POST", uri: "/convert", age: -6 * time.Minute},
+		{name: "tampered path", method: "GET", uri: "/jobs?status=failed", sentUri: "/jobs/42?status=failed"},
+		{name: "tampered query", method: "GET", uri: "/jobs?status=failed", sentUri: "/jobs?status=completed"},
+		{name: "tampered method", method: "GET", uri: "/convert", sentMethod: "POST"},
+		{name: "tampered body", method: "POST", uri: "/convert", sentBody: form + "&params[queue]=other"},
+		{name: "missing signature", method: "POST", uri: "/convert", unsigned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == "POST" {
+				body = form
+			}
+			r := signed(tt.method, tt.uri, body, time.Now().Add(-tt.age))
+			if tt.sentMethod != "" {
+				r.Method = tt.sentMethod
+			}
+			if tt.sentUri != "" {
+				r.URL, _ = url.Parse(tt.sentUri)
+				r.RequestURI = tt.sentUri
+			}
+			if tt.sentBody != "" {
+				r.Body = io.NopCloser(strings.NewReader(tt.sentBody))
+			}
+			if tt.unsigned {
+				r.Header.Del(SignatureHeader)
+			}
+
+			err := a.VerifyRequest(httptest.NewRecorder(), r)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			var authErr *Error
+			if !errors.As(err, &authErr) || authErr.Code != resp.CodeRightCheckFailed {
+				t.Fatalf("got %v, want a rejection with code %d", err, resp.CodeRightCheckFailed)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestRestoresBody(t *testing.T) {
+	a := New(config.AuthConfig{Secret: secret, SignatureTTL: time.Minute})
+	r := signed("POST", "/convert", "a=1", time.Now())
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := a.VerifyRequest(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ParseForm(); err != nil || r.Form.Get("a") != "1" {
+		t.Fatalf("form after verification: %v, %v", r.Form, err)
+	}
+}
+
+func TestVerifyRequestAPIKey(t *testing.T) {
+	a := New(config.AuthConfig{APIKeys: []string{"first", " second "}})
+
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{"Bearer first", true},
+		{"Bearer second", true},
+		{"Bearer third", false},
+		{"first", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/jobs", nil)
+			r.Header.Set("Authorization", tt.header)
+			if err := a.VerifyRequest(httptest.NewRecorder(), r); (err == nil) != tt.valid {
+				t.Fatalf("got %v, valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestVerifyUrls(t *testing.T) {
+	a := New(config.AuthConfig{AllowedDomains: []string{"Example.com"}})
+
+	tests := []struct {
+		name    string
+		backUrl string
+		file    string
+		code    int
+	}{
+		{"domain", "https://example.com/back", "https://example.com/a.docx", 0},
+		{"subdomain", "https://b24.example.com/back", "http://cdn.b24.example.com/a.docx", 0},
+		{"other back_url", "https://example.org/back", "https://example.com/a.docx", resp.CodeBannedDomain},
+		{"other file", "https://example.com/back", "https://evil-example.com/a.docx", resp.CodeBannedDomain},
+		{"suffix without dot", "https://notexample.com/back", "https://example.com/a.docx", resp.CodeBannedDomain},
+		{"not http", "https://example.com/back", "file://example.com/etc/passwd", resp.CodeBannedDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.VerifyUrls(tt.backUrl, tt.file)
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			var authErr *Error
+			if !errors.As(err, &authErr) || authErr.Code != tt.code {
+				t.Fatalf("got %v, want code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestNothingConfigured(t *testing.T) {
+	a := New(config.AuthConfig{})
+
+	if err := a.VerifyRequest(httptest.NewRecorder(), httptest.NewRequest("POST", "/convert", nil)); err != nil {
+		t.Fatalf("request rejected without checks: %v", err)
+	}
+	if err := a.VerifyUrls("https://any.example/back", "https://other.example/a"); err != nil {
+		t.Fatalf("urls rejected without checks: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package command
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	checksumFormats = map[string]func() hash.Hash{
+		"md5":   md5.New,
+		"sha1":  sha1.New,
+		"crc32": func() hash.Hash { return crc32.NewIEEE() },
+	}
+)
+
+func isChecksumFormat(format string) bool {
+	_, ok := checksumFormats[format]
+	return ok
+}
+
+// checksums reads the original file once and writes a hex digest file for every
+// checksum format requested in the task.
+func (bs *BaseCommand) checksums(filePath string, directory string) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(checksumFormats))
+
+	for _, format := range bs.task.Formats {
+		newHash, ok := checksumFormats[format]
+		if !ok {
+			continue
+		}
+		if _, ok = hashes[format]; ok {
+			continue
+		}
+		h := newHash()
+		hashes[format] = h
+		writers = append(writers, h)
+	}
+
+	result := make(map[string]string, len(hashes))
+
+	if len(hashes) == 0 {
+		return result, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error open file [%s]: [%w]", filePath, err)
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, fmt.Errorf("error read file [%s]: [%w]", filePath, err)
+	}
+
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error create directory [%s]: [%w]", directory, err)
+	}
+
+	for format, h := range hashes {
+		sumFile := filepath.Join(directory, filepath.Base(filePath)+"."+format)
+		bs.uploader.AddFileToDelete(sumFile)
+
+		sum := hex.EncodeToString(h.Sum(nil))
+		if err = os.WriteFile(sumFile, []byte(sum), 0644); err != nil {
+			return nil, fmt.Errorf("error write checksum file [%s]: [%w]", sumFile, err)
+		}
+		result[format] = sumFile
+	}
+
+	return result, nil
+}
@@ -3,8 +3,13 @@ package command
 import (
 	"bitrix-converter/internal/config"
 	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/tracing"
+	"context"
 	"fmt"
 	"github.com/avast/retry-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -13,18 +18,20 @@ import (
 )
 
 type Command interface {
-	Execute() error
+	Execute(ctx context.Context) error
+	Fail(ctx context.Context, err error) error
 	validate() error
-	transform(format string, filePath string) (string, error)
+	transform(ctx context.Context, format string, filePath string) (string, error)
 	MaxSize() int64
 	ConvertDir() string
 	DownloadDir() string
-	preConvert(format string, filePath string) (bool, error)
+	preConvert(ctx context.Context, format string, filePath string) (bool, error)
 }
 
 type BaseCommand struct {
 	Command
 	uploader fileuploader.FileUploader
+	reporter *jobs.Reporter
 	log      *slog.Logger
 	task     ConvertTask
 	cfg      config.ConvertConfig
@@ -51,10 +58,62 @@ func (bs *BaseCommand) genTmpFilePath(directory string) string {
 
 }
 
-func (bs *BaseCommand) Execute() error {
+func (bs *BaseCommand) report(status jobs.Status, err error) {
+	e := jobs.Event{
+		JobID:  bs.task.RequestID,
+		Status: status,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if status == jobs.StatusCompleted {
+		e.Files = bs.uploader.UploadedFiles()
+	}
+	bs.reporter.Report(e)
+}
+
+func (bs *BaseCommand) Execute(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "command.Execute", trace.WithAttributes(
+		attribute.String("command", bs.task.Command),
+		attribute.String("job_id", bs.task.RequestID),
+	))
+	err := bs.execute(ctx)
+	tracing.End(span, err)
+
+	if ctx.Err() != nil && err != nil {
+		// the consumer is stopping, the task goes back to the queue
+		bs.report(jobs.StatusQueued, err)
+		return err
+	}
+	if err != nil {
+		// the consumer reports the failure once it decides whether the task is retried
+		return err
+	}
+	bs.report(jobs.StatusCompleted, nil)
+	return nil
+}
+
+// Fail finishes the task on the portal with the Bitrix24 error code of err.
+func (bs *BaseCommand) Fail(ctx context.Context, err error) error {
+	return bs.uploader.Fail(ctx, ErrorCode(err), err.Error())
+}
+
+func (bs *BaseCommand) execute(ctx context.Context) error {
 
 	if err := bs.validate(); err != nil {
-		return fmt.Errorf("failed validate transform task: [%w]", err)
+		return withClass(ClassTerminal, fmt.Errorf("failed validate transform task: [%w]", err))
+	}
+
+	if files := bs.uploader.Resume(); files != nil {
+		// an earlier delivery has converted the file and started the upload
+		bs.log.Info("resume upload", slog.Int("files", len(files)))
+		for _, file := range files {
+			bs.uploader.AddFileToDelete(file)
+		}
+		defer bs.uploader.DeleteFiles()
+
+		bs.files = files
+		return bs.upload(ctx)
 	}
 
 	directory := bs.DownloadDir()
@@ -67,11 +126,16 @@ func (bs *BaseCommand) Execute() error {
 
 	filePath := bs.genTmpFilePath(directory)
 
+	bs.report(jobs.StatusDownloading, nil)
+
 	err = retry.Do(
 		func() error {
-			return bs.uploader.Download(bs.task.File, filePath, bs.MaxSize())
+			return bs.uploader.Download(ctx, bs.task.File, filePath, bs.MaxSize(), bs.task.FileSize)
 		},
 		retry.Attempts(3),
+		retry.RetryIf(fileuploader.Retryable),
+		retry.LastErrorOnly(true),
+		retry.Context(ctx),
 		retry.OnRetry(func(n uint, err error) {
 			time.Sleep(1 * time.Second)
 		}),
@@ -82,43 +146,65 @@ func (bs *BaseCommand) Execute() error {
 	defer bs.uploader.DeleteFiles()
 
 	if err != nil {
-		return fmt.Errorf("error download file [%s]: [%w]", bs.task.File, err)
+		return withClass(ClassDownload, fmt.Errorf("error download file [%s]: [%w]", bs.task.File, err))
 	}
 
 	bs.file = filePath
 
+	bs.report(jobs.StatusConverting, nil)
+
 	for _, format := range bs.task.Formats {
 
 		if _, ok := bs.files[format]; ok {
 			continue
 		}
-		pre, err := bs.preConvert(format, filePath)
-
-		if err != nil {
-			return err
-		}
-		if pre {
-			continue
-		}
-
-		convertedFile, err := bs.transform(format, filePath)
-		bs.uploader.AddFileToDelete(convertedFile)
-		if err != nil {
-			return fmt.Errorf("error transform file [%s] to [%s]: [%w]", bs.task.File, format, err)
+		if err = bs.convert(ctx, format, filePath); err != nil {
+			return withClass(ClassConvert, err)
 		}
-		bs.files[format] = convertedFile
 	}
 
+	return bs.upload(ctx)
+}
+
+func (bs *BaseCommand) upload(ctx context.Context) error {
 	bs.uploader.SetFiles(bs.files)
 
-	err = bs.uploader.UploadFiles()
+	bs.report(jobs.StatusUploading, nil)
+
+	err := bs.uploader.UploadFiles(ctx)
+	if err != nil {
+		return withClass(ClassUpload, fmt.Errorf("error uploading files: [%w]", err))
+	}
+
+	err = bs.uploader.Complete(ctx)
+	if err != nil {
+		return withClass(ClassUpload, fmt.Errorf("failed complete: [%w]", err))
+	}
+	return nil
+}
+
+func (bs *BaseCommand) convert(ctx context.Context, format string, filePath string) error {
+	attrs := trace.WithAttributes(attribute.String("format", format))
+
+	preCtx, span := tracing.Start(ctx, "command.preConvert", attrs)
+	pre, err := bs.preConvert(preCtx, format, filePath)
+	tracing.End(span, err)
+
 	if err != nil {
-		return fmt.Errorf("error uploading files: [%w]", err)
+		return err
 	}
+	if pre {
+		return nil
+	}
+
+	ctx, span = tracing.Start(ctx, "command.transform", attrs)
+	convertedFile, err := bs.transform(ctx, format, filePath)
+	tracing.End(span, err)
 
-	err = bs.uploader.Complete()
+	bs.uploader.AddFileToDelete(convertedFile)
 	if err != nil {
-		return fmt.Errorf("failed complete: [%w]", err)
+		return fmt.Errorf("error transform file [%s] to [%s]: [%w]", bs.task.File, format, err)
 	}
+	bs.files[format] = convertedFile
 	return nil
 }
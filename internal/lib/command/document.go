@@ -4,18 +4,24 @@ import (
 	"archive/zip"
 	"bitrix-converter/internal/config"
 	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/libreoffice"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/metrics"
 	"bitrix-converter/internal/lib/util"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
     "time"
 	"io"
+	"maps"
 	"net/http"
 	"slices"
 	"strings"
 
 	"log/slog"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -23,13 +29,16 @@ import (
 
 const (
 	libreofficeCommand = "libreoffice"
-	libreofficeArg     = "-env:UserInstallation=file://%s --convert-to %s --outdir %s %s --headless --display :0"
+	unoconvertCommand  = "unoconvert"
+	libreofficeArg     = "-env:UserInstallation=file://%s --outdir %s %s --headless --display :0"
 	documentDir        = "documents"
 	imageMagicCommand  = "convert"
 	imageMagicArg      = "-density 150 %s -quality 90 %s"
 )
 
 var (
+	errPoolUnsupported = errors.New("conversion is not supported by libreoffice pool")
+
 	convertFromPdf = []string{
 		"jpg",
 		"pngAllPages",
@@ -39,11 +48,13 @@ var (
 type DocumentCommand struct {
 	*BaseCommand
 	uniqId string
+	pool   *libreoffice.Pool
 }
 
-func NewDocumentCommand(task ConvertTask, log *slog.Logger, uploader fileuploader.FileUploader, cfg config.ConvertConfig, uniqId string) *DocumentCommand {
+func NewDocumentCommand(task ConvertTask, log *slog.Logger, uploader fileuploader.FileUploader, reporter *jobs.Reporter, cfg config.ConvertConfig, uniqId string, pool *libreoffice.Pool) *DocumentCommand {
 	bs := BaseCommand{
 		uploader: uploader,
+		reporter: reporter,
 		task:     task,
 		log:      log,
 		cfg:      cfg,
@@ -52,6 +63,7 @@ func NewDocumentCommand(task ConvertTask, log *slog.Logger, uploader fileuploade
 	doc := &DocumentCommand{
 		BaseCommand: &bs,
 		uniqId:      uniqId,
+		pool:        pool,
 	}
 	bs.Command = doc
 	return doc
@@ -72,7 +84,7 @@ func (d *DocumentCommand) validate() error {
 
 }
 
-func (d *DocumentCommand) transform(format string, filePath string) (string, error) {
+func (d *DocumentCommand) transform(ctx context.Context, format string, filePath string) (string, error) {
 	fileInfo, err := os.Stat(filePath)
 
 	if err != nil {
@@ -87,29 +99,120 @@ func (d *DocumentCommand) transform(format string, filePath string) (string, err
 		return "", fmt.Errorf("error create directory [%s]: [%w]", directory, err)
 	}
 
+	if err = d.libreoffice(ctx, format, directory, filePath); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, util.FileNameNotExt(fileInfo.Name())+"."+format), nil
+}
+
+// libreoffice converts the file with the pool, or runs a one-shot headless LibreOffice with its own
+// profile directory. Both share one DocumentTimeout, so a conversion that timed out in the pool
+// is not started again in one-shot mode.
+// convertTo is passed as a single argument, so it may contain a filter name with spaces.
+func (d *DocumentCommand) libreoffice(ctx context.Context, convertTo string, directory string, filePath string) error {
+	if d.cfg.DocumentTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.cfg.DocumentTimeout)
+		defer cancel()
+	}
+
+	if d.pool != nil {
+		err := d.pooledLibreoffice(ctx, convertTo, directory, filePath)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, ErrTimeout) {
+			// the deadline passed while waiting for an instance
+			err = fmt.Errorf("libreoffice pool did not convert within [%s]: [%w]", d.cfg.DocumentTimeout, ErrTimeout)
+		}
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrTimeout) {
+			return err
+		}
+		if !errors.Is(err, errPoolUnsupported) {
+			d.log.Warn("libreoffice pool conversion failed. Fallback to one-shot mode", sl.Err(err))
+		}
+	}
+
 	randTmpDir := filepath.Join(os.TempDir(), "libreoffice", d.uniqId, strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer os.RemoveAll(randTmpDir)
+
+	args := strings.Fields(fmt.Sprintf(libreofficeArg, randTmpDir, directory, filePath))
+	args = append(args, "--convert-to", convertTo)
 
-	args := strings.Fields(fmt.Sprintf(libreofficeArg, randTmpDir, format, directory, filePath))
+	format, _, _ := strings.Cut(convertTo, ":")
 
-	cmd := exec.Command(libreofficeCommand, args...)
+	err := run(ctx, d.cfg.DocumentTimeout, metrics.ToolLibreoffice, format, libreofficeCommand, args...)
+	if err != nil {
+		return fmt.Errorf("error libreoffice command file [%s]: [%w]", filePath, err)
+	}
+	return nil
+}
 
-	if err = cmd.Run(); err != nil {
-        os.RemoveAll(randTmpDir)
-		return "", fmt.Errorf("error libreoffice command file [%s]: [%w]", filePath, err)
+// pooledLibreoffice converts the file with a long-lived instance from the pool through unoconvert.
+// Filter options are not supported by unoconvert, such conversions use the one-shot mode.
+func (d *DocumentCommand) pooledLibreoffice(ctx context.Context, convertTo string, directory string, filePath string) error {
+	parts := strings.SplitN(convertTo, ":", 3)
+	if len(parts) == 3 {
+		return errPoolUnsupported
 	}
 
-    os.RemoveAll(randTmpDir)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return fmt.Errorf("error create directory [%s]: [%w]", directory, err)
+	}
 
-	return filepath.Join(directory, util.FileNameNotExt(fileInfo.Name())+"."+format), nil
+	inst, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	output := filepath.Join(directory, util.FileNameNotExt(filepath.Base(filePath))+"."+parts[0])
+
+	args := []string{
+		"--host", "127.0.0.1",
+		"--port", strconv.Itoa(inst.Port()),
+		"--convert-to", parts[0],
+	}
+	if len(parts) == 2 {
+		args = append(args, "--filter", parts[1])
+	}
+	args = append(args, filePath, output)
+
+	err = run(ctx, d.cfg.DocumentTimeout, metrics.ToolLibreoffice, parts[0], unoconvertCommand, args...)
+	d.pool.Release(inst, err)
+
+	if err != nil {
+		return fmt.Errorf("error unoconvert command file [%s]: [%w]", filePath, err)
+	}
+	return nil
 }
 
-func (d *DocumentCommand) preConvert(format string, filePath string) (bool, error) {
+func (d *DocumentCommand) preConvert(ctx context.Context, format string, filePath string) (bool, error) {
+	if isChecksumFormat(format) {
+		sums, err := d.checksums(filePath, d.SuccessDir())
+		if err != nil {
+			return false, fmt.Errorf("error calculate checksum file [%s]: [%w]", d.task.File, err)
+		}
+		maps.Copy(d.files, sums)
+		return true, nil
+	}
+
+	if isTextFormat(format) {
+		txt, err := d.extractText(ctx, filePath)
+		if err != nil {
+			return false, fmt.Errorf("error extract text from file [%s]: [%w]", d.task.File, err)
+		}
+		for _, f := range d.task.Formats {
+			if isTextFormat(f) {
+				d.files[f] = txt
+			}
+		}
+		return true, nil
+	}
+
 	needConvert := slices.Contains(convertFromPdf, format)
 	if needConvert {
 		pdf := d.existPdfFile()
 		var err error
 		if pdf == "" {
-			pdf, err = d.transform("pdf", filePath)
+			pdf, err = d.transform(ctx, "pdf", filePath)
 			if err != nil {
 				return false, fmt.Errorf("error transform file [%s] to [%s]: [%w]", d.task.File, format, err)
 			}
@@ -122,7 +225,7 @@ func (d *DocumentCommand) preConvert(format string, filePath string) (bool, erro
 
 		switch format {
 		case "jpg":
-			jpg, err := d.transform(format, pdf)
+			jpg, err := d.transform(ctx, format, pdf)
 			d.uploader.AddFileToDelete(jpg)
 			if err != nil {
 				return false, fmt.Errorf("error transform file [%s] to [%s]: [%w]", d.task.File, format, err)
@@ -130,7 +233,7 @@ func (d *DocumentCommand) preConvert(format string, filePath string) (bool, erro
 			d.files[format] = jpg
 			return true, nil
 		case "pngAllPages":
-			zipPath, err := d.convertToPng(pdf)
+			zipPath, err := d.convertToPng(ctx, pdf)
 
 			if err != nil {
 				return false, fmt.Errorf("error transform file to pngAllPages [%s]: [%w]", pdf, err)
@@ -143,18 +246,18 @@ func (d *DocumentCommand) preConvert(format string, filePath string) (bool, erro
 	return false, nil
 }
 
-func (d *DocumentCommand) convertToPng(pdf string) (string, error) {
+func (d *DocumentCommand) convertToPng(ctx context.Context, pdf string) (string, error) {
 	pngFileName := pdf + ".png"
 	pngs := map[string]string{}
 
 	args := strings.Fields(fmt.Sprintf(imageMagicArg, pdf, pngFileName))
 
-	cmd := exec.Command(imageMagicCommand, args...)
-	if err := cmd.Run(); err != nil {
+	err := run(ctx, d.cfg.ImageTimeout, metrics.ToolImageMagick, "pngAllPages", imageMagicCommand, args...)
+	if err != nil {
 		return "", fmt.Errorf("error image magic command: [%w]", err)
 	}
 
-	_, err := os.Stat(pngFileName)
+	_, err = os.Stat(pngFileName)
 	if err == nil {
 		pngs["0.png"] = pngFileName
 		d.uploader.AddFileToDelete(pngFileName)
@@ -0,0 +1,85 @@
+package command
+
+import (
+	"bitrix-converter/internal/lib/api/response"
+	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/netguard"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"slices"
+)
+
+// Error classes of a failed task. The consumer picks the retry policy by the class,
+// terminal failures are never retried.
+const (
+	ClassTerminal = "terminal"
+	ClassDownload = "download"
+	ClassConvert  = "convert"
+	ClassUpload   = "upload"
+)
+
+type classError struct {
+	class string
+	err   error
+}
+
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classError) Unwrap() error {
+	return e.err
+}
+
+func withClass(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: class, err: err}
+}
+
+// ErrorClass returns the class of an error returned by Execute. Forbidden destinations, files
+// over the size limit and files of another size than the task expects are terminal at any stage.
+func ErrorClass(err error) string {
+	if errors.Is(err, netguard.ErrBlocked) || errors.Is(err, fileuploader.ErrFileTooBig) ||
+		errors.Is(err, fileuploader.ErrUnexpectedSize) {
+		return ClassTerminal
+	}
+	var ce *classError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return ClassTerminal
+}
+
+// ErrorCode maps an error returned by Execute to the error code of the Bitrix24 transformer module.
+func ErrorCode(err error) int {
+	var validationErrs validator.ValidationErrors
+
+	switch {
+	case errors.Is(err, netguard.ErrBlocked):
+		return response.CodeBannedDomain
+	case errors.Is(err, fileuploader.ErrFileTooBig), errors.Is(err, fileuploader.ErrUnexpectedSize):
+		return response.CodeDownloadSize
+	case errors.Is(err, fileuploader.ErrContentType):
+		return response.CodeDownloadType
+	case errors.Is(err, fileuploader.ErrDownloadStatus):
+		return response.CodeDownloadStatus
+	case errors.Is(err, ErrTimeout):
+		return response.CodeTransformationTimeout
+	case errors.As(err, &validationErrs) && slices.ContainsFunc(validationErrs, isFormatError):
+		return response.CodeUnsupportedFormat
+	}
+
+	switch ErrorClass(err) {
+	case ClassDownload:
+		return response.CodeDownload
+	case ClassUpload:
+		return response.CodeUpload
+	}
+	return response.CodeTransformation
+}
+
+func isFormatError(fe validator.FieldError) bool {
+	return fe.Tag() == "oneof"
+}
@@ -0,0 +1,64 @@
+package command
+
+import (
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/procgroup"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// waitDelay bounds the wait for output pipes after the process group was killed
+	waitDelay  = 5 * time.Second
+	stderrTail = 512
+)
+
+var (
+	ErrTimeout = errors.New("conversion timed out")
+)
+
+// run executes an external tool in its own process group. When the timeout expires or
+// ctx is canceled the whole group is killed, so helpers spawned by the tool do not linger.
+func run(ctx context.Context, timeout time.Duration, tool string, format string, name string, args ...string) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	procgroup.Set(cmd)
+	cmd.WaitDelay = waitDelay
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	metrics.ObserveConversion(tool, format, start, err)
+
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s killed after [%s]: [%w]", name, timeout, ErrTimeout)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s interrupted: [%w]", name, ctx.Err())
+	}
+
+	output := strings.TrimSpace(stderr.String())
+	if len(output) > stderrTail {
+		output = output[len(output)-stderrTail:]
+	}
+	if output != "" {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return err
+}
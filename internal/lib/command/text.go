@@ -0,0 +1,324 @@
+package command
+
+import (
+	"archive/zip"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/util"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	pdfToTextCommand      = "pdftotext"
+	pdfToTextArg          = "-q -enc UTF-8 -layout %s %s"
+	textFilter            = "txt:Text (encoded):UTF8,LF"
+	spreadsheetTextFilter = "csv:Text - txt - csv (StarCalc):9,34,76,1"
+)
+
+const (
+	sourceOther = iota
+	sourcePdf
+	sourceSpreadsheet
+	sourceHtml
+	sourceText
+)
+
+var (
+	textFormats = []string{
+		"txt",
+		"text",
+	}
+	utf8Bom = []byte{0xEF, 0xBB, 0xBF}
+
+	// blockTags end a line when html is flattened to text.
+	blockTags = map[string]bool{
+		"br": true, "p": true, "div": true, "li": true, "tr": true, "table": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"pre": true, "blockquote": true, "section": true, "article": true,
+	}
+)
+
+func isTextFormat(format string) bool {
+	return slices.Contains(textFormats, format)
+}
+
+// extractText produces a normalized UTF-8 text file from the original document.
+func (d *DocumentCommand) extractText(ctx context.Context, filePath string) (string, error) {
+	directory := d.SuccessDir()
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error create directory [%s]: [%w]", directory, err)
+	}
+
+	raw, err := d.rawText(ctx, filePath, directory, rawLimit(d.cfg.MaxTextSize))
+	if err != nil {
+		return "", err
+	}
+
+	txtFile := filepath.Join(directory, filepath.Base(filePath)+".txt")
+	d.uploader.AddFileToDelete(txtFile)
+
+	text := capText(normalizeText(raw), d.cfg.MaxTextSize)
+
+	if err = os.WriteFile(txtFile, text, 0644); err != nil {
+		return "", fmt.Errorf("error write text file [%s]: [%w]", txtFile, err)
+	}
+	return txtFile, nil
+}
+
+// rawLimit is how much extracted text is read for a text of maxSize bytes. Decoding to UTF-8
+// shrinks UTF-16 at most twice, so the text is never shorter than maxSize unless the file is.
+func rawLimit(maxSize int64) int64 {
+	if maxSize <= 0 {
+		return 0
+	}
+	return 2*maxSize + int64(len(utf8Bom))
+}
+
+// rawText extracts up to limit bytes of text, all of it if limit is not positive.
+func (d *DocumentCommand) rawText(ctx context.Context, filePath string, directory string, limit int64) ([]byte, error) {
+	switch detectTextSource(filePath) {
+	case sourceText:
+		return readFile(filePath, limit)
+	case sourceHtml:
+		return htmlToText(filePath, limit)
+	case sourcePdf:
+		out := filepath.Join(directory, filepath.Base(filePath)+".pdf.txt")
+		d.uploader.AddFileToDelete(out)
+
+		args := strings.Fields(fmt.Sprintf(pdfToTextArg, filePath, out))
+		err := run(ctx, d.cfg.DocumentTimeout, metrics.ToolPdfToText, "txt", pdfToTextCommand, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error pdftotext command file [%s]: [%w]", filePath, err)
+		}
+		return readFile(out, limit)
+	case sourceSpreadsheet:
+		return d.libreofficeText(ctx, spreadsheetTextFilter, "csv", filePath, directory, limit)
+	default:
+		text, err := d.libreofficeText(ctx, textFilter, "txt", filePath, directory, limit)
+		if err == nil {
+			return text, nil
+		}
+		// legacy binary formats do not tell writer and calc documents apart
+		return d.libreofficeText(ctx, spreadsheetTextFilter, "csv", filePath, directory, limit)
+	}
+}
+
+func (d *DocumentCommand) libreofficeText(ctx context.Context, filter string, ext string, filePath string, directory string, limit int64) ([]byte, error) {
+	outDir := filepath.Join(directory, filepath.Base(filePath)+"_text")
+	defer os.RemoveAll(outDir)
+
+	if err := d.libreoffice(ctx, filter, outDir, filePath); err != nil {
+		return nil, err
+	}
+
+	return readFile(filepath.Join(outDir, util.FileNameNotExt(filepath.Base(filePath))+"."+ext), limit)
+}
+
+func detectTextSource(filePath string) int {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return sourceOther
+	}
+	defer f.Close()
+
+	buffer := make([]byte, 512)
+	n, err := f.Read(buffer)
+	if err != nil && err != io.EOF {
+		return sourceOther
+	}
+
+	contentType := http.DetectContentType(buffer[:n])
+
+	switch {
+	case contentType == "application/pdf":
+		return sourcePdf
+	case strings.HasPrefix(contentType, "text/html"):
+		return sourceHtml
+	case strings.HasPrefix(contentType, "text/plain"):
+		return sourceText
+	case contentType == "application/zip":
+		if isSpreadsheetArchive(filePath) {
+			return sourceSpreadsheet
+		}
+	}
+	return sourceOther
+}
+
+// isSpreadsheetArchive recognizes xlsx and ods containers.
+func isSpreadsheetArchive(filePath string) bool {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		if file.Name == "xl/workbook.xml" {
+			return true
+		}
+		if file.Name != "mimetype" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return false
+		}
+		mimeType, err := io.ReadAll(io.LimitReader(rc, 128))
+		rc.Close()
+		if err != nil {
+			return false
+		}
+		return strings.Contains(string(mimeType), "spreadsheet")
+	}
+	return false
+}
+
+// htmlToText flattens the html to UTF-8 text, the text is cut at limit bytes if limit is positive.
+func htmlToText(filePath string, limit int64) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error open file [%s]: [%w]", filePath, err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	skip := 0
+	z := html.NewTokenizer(htmlReader(f))
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return buf.Bytes(), nil
+			}
+			return nil, fmt.Errorf("error parse html file [%s]: [%w]", filePath, z.Err())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case tag == "script" || tag == "style":
+				skip++
+			case blockTags[tag]:
+				buf.WriteByte('\n')
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case (tag == "script" || tag == "style") && skip > 0:
+				skip--
+			case blockTags[tag]:
+				buf.WriteByte('\n')
+			}
+		case html.TextToken:
+			if skip == 0 {
+				buf.Write(z.Text())
+			}
+			if limit > 0 && int64(buf.Len()) > limit {
+				return trimPartialRune(buf.Bytes()[:limit]), nil
+			}
+		}
+	}
+}
+
+// htmlReader decodes the html to UTF-8 before it is tokenized, so entities and text end up
+// in one encoding. The encoding is taken from the BOM or the meta charset, an html that
+// declares nothing and is not UTF-8 is read as CP1251 like plain text.
+func htmlReader(r io.Reader) io.Reader {
+	br := bufio.NewReaderSize(r, 1024)
+	head, _ := br.Peek(1024)
+
+	e, name, certain := charset.DetermineEncoding(head, "")
+	if !certain && name == "windows-1252" && !bytes.Contains(bytes.ToLower(head), []byte("charset")) {
+		e = charmap.Windows1251
+	}
+	return e.NewDecoder().Reader(br)
+}
+
+// normalizeText converts the text to UTF-8 and unix line endings.
+// Anything that is not valid UTF-8 or UTF-16 with BOM is treated as CP1251.
+func normalizeText(text []byte) []byte {
+	switch {
+	case bytes.HasPrefix(text, utf8Bom):
+		text = text[len(utf8Bom):]
+	case bytes.HasPrefix(text, []byte{0xFF, 0xFE}), bytes.HasPrefix(text, []byte{0xFE, 0xFF}):
+		decoded, err := unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder().Bytes(text)
+		if err == nil {
+			text = decoded
+		}
+	}
+
+	if !utf8.Valid(text) {
+		decoded, err := charmap.Windows1251.NewDecoder().Bytes(text)
+		if err == nil {
+			text = decoded
+		}
+	}
+
+	text = bytes.ReplaceAll(text, []byte("\r\n"), []byte("\n"))
+	text = bytes.ReplaceAll(text, []byte("\r"), []byte("\n"))
+
+	return text
+}
+
+// capText cuts the text to maxSize bytes without splitting a multibyte rune.
+func capText(text []byte, maxSize int64) []byte {
+	if maxSize <= 0 || int64(len(text)) <= maxSize {
+		return text
+	}
+	end := int(maxSize)
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end]
+}
+
+// readFile reads up to limit bytes of the file, all of it if limit is not positive.
+func readFile(filePath string, limit int64) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error read file [%s]: [%w]", filePath, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit > 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error read file [%s]: [%w]", filePath, err)
+	}
+	if limit > 0 && int64(len(data)) == limit {
+		data = trimPartialRune(data)
+	}
+	return data, nil
+}
+
+// trimPartialRune drops a UTF-8 sequence cut at the end of the text, so the text is not
+// taken for CP1251 because of it.
+func trimPartialRune(text []byte) []byte {
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			if !utf8.FullRune(text[i:]) {
+				return text[:i]
+			}
+			break
+		}
+	}
+	return text
+}
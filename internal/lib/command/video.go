@@ -3,14 +3,15 @@ package command
 import (
 	"bitrix-converter/internal/config"
 	"bitrix-converter/internal/lib/fileuploader"
-	"bytes"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/metrics"
+	"context"
 	"fmt"
 	"github.com/go-playground/validator/v10"
 	"strings"
 
 	"log/slog"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 )
@@ -27,9 +28,10 @@ type VideoCommand struct {
 	*BaseCommand
 }
 
-func NewVideoCommand(task ConvertTask, log *slog.Logger, uploader fileuploader.FileUploader, cfg config.ConvertConfig) *VideoCommand {
+func NewVideoCommand(task ConvertTask, log *slog.Logger, uploader fileuploader.FileUploader, reporter *jobs.Reporter, cfg config.ConvertConfig) *VideoCommand {
 	bs := BaseCommand{
 		uploader: uploader,
+		reporter: reporter,
 		task:     task,
 		log:      log,
 		cfg:      cfg,
@@ -56,7 +58,7 @@ func (v *VideoCommand) validate() error {
 
 }
 
-func (v *VideoCommand) transform(format string, filePath string) (string, error) {
+func (v *VideoCommand) transform(ctx context.Context, format string, filePath string) (string, error) {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return "", fmt.Errorf("error get file info [%s]: [%w]", filePath, err)
@@ -67,7 +69,6 @@ func (v *VideoCommand) transform(format string, filePath string) (string, error)
 		return "", fmt.Errorf("error creating directory [%s]: [%w]", directory, err)
 	}
 	file := filepath.Join(directory, fileInfo.Name()+"."+format)
-	cmd := &exec.Cmd{}
 	var args []string
 	switch format {
 	case "mp4":
@@ -77,17 +78,15 @@ func (v *VideoCommand) transform(format string, filePath string) (string, error)
 	default:
 		return "", fmt.Errorf("unknown format [%s]", format)
 	}
-	cmd = exec.Command(videoCommand, args...)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err = cmd.Run(); err != nil {
+	err = run(ctx, v.cfg.VideoTimeout, metrics.ToolFfmpeg, format, videoCommand, args...)
+	if err != nil {
 		return "", fmt.Errorf("error ffmpeg command. file %s: [%w]", filePath, err)
 	}
 
 	return file, nil
 }
 
-func (v *VideoCommand) preConvert(format string, filePath string) (bool, error) {
+func (v *VideoCommand) preConvert(ctx context.Context, format string, filePath string) (bool, error) {
 	return false, nil
 }
 
@@ -0,0 +1,189 @@
+package consumer
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/api/response"
+	"bitrix-converter/internal/lib/command"
+	"bitrix-converter/internal/lib/fileuploader"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/libreoffice"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/netguard"
+	"bitrix-converter/internal/lib/queue"
+	"bitrix-converter/internal/lib/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Consumer converts the tasks taken from the queue.
+type Consumer struct {
+	log     *slog.Logger
+	cfg     *config.Config
+	queue   queue.Queue
+	guard   *netguard.Guard
+	pool    *libreoffice.Pool
+	uploads *fileuploader.State
+}
+
+func New(log *slog.Logger, cfg *config.Config, q queue.Queue, guard *netguard.Guard, pool *libreoffice.Pool, uploads *fileuploader.State) *Consumer {
+	return &Consumer{
+		log:     log,
+		cfg:     cfg,
+		queue:   q,
+		guard:   guard,
+		pool:    pool,
+		uploads: uploads,
+	}
+}
+
+// HandleMessage runs the task of the message and settles it: acks it on success, sends it to a retry
+// or rejects it to the dead-letter queue on failure and requeues it when ctx is canceled.
+func (c *Consumer) HandleMessage(ctx context.Context, m queue.Message, uniqId string) {
+	const op = "consumer.HandleMessage"
+
+	log := c.log
+
+	task := command.ConvertTask{}
+	queueName := m.Queue
+
+	ctx = queue.ExtractContext(ctx, m.Headers)
+	ctx, span := tracing.Start(ctx, op,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", queueName)),
+	)
+	defer span.End()
+
+	err := json.Unmarshal(m.Body, &task)
+	if err != nil {
+		log.Error("failed to parse body messages", slog.String("queue", queueName), sl.Err(err))
+		_ = m.Reject()
+		metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeReject).Inc()
+		return
+	}
+
+	log = log.With(
+		slog.String("op", op),
+		slog.String("request_id", task.RequestID),
+		slog.Int("priority", int(m.Priority)),
+	)
+
+	uploader := fileuploader.New(task.BackUrl, c.guard)
+	uploader.SetState(c.uploads, task.RequestID)
+	uploader.SetParallelism(c.cfg.Convert.UploadParallelism)
+	reporter := jobs.NewReporter(c.queue, log, uniqId)
+	var cmd command.Command
+
+	switch task.Command {
+	case "Bitrix\\TransformerController\\Document":
+		cmd = command.NewDocumentCommand(task, log, *uploader, reporter, c.cfg.Convert, uniqId, c.pool)
+	case "Bitrix\\TransformerController\\Video":
+		cmd = command.NewVideoCommand(task, log, *uploader, reporter, c.cfg.Convert)
+	default:
+		log.Error("failed to get command",
+			slog.String("queue", queueName),
+			slog.String("command", task.Command))
+		reporter.Report(jobs.Event{
+			JobID:  task.RequestID,
+			Status: jobs.StatusFailed,
+			Error:  "unknown command " + task.Command,
+		})
+		if fErr := uploader.Fail(ctx, response.CodeCommandNotFound, "unknown command "+task.Command); fErr != nil {
+			log.Error("failed to notify portal about the failure", sl.Err(fErr))
+		}
+		_ = m.Reject()
+		metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeReject).Inc()
+		return
+	}
+
+	err = cmd.Execute(ctx)
+	if err != nil && ctx.Err() != nil {
+		log.Warn("command interrupted by shutdown. Requeue",
+			slog.String("queue", queueName),
+			slog.String("command", task.Command),
+			sl.Err(err))
+		_ = m.Requeue()
+		metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeRequeue).Inc()
+		return
+	}
+	if err != nil {
+		c.fail(ctx, m, log, reporter, cmd, task, err)
+		return
+	}
+	_ = m.Ack()
+	metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeAck).Inc()
+}
+
+// fail sends a failed task to the retry queue with the backoff of its error class.
+// Terminal errors and tasks out of attempts are reported to the portal and rejected to the dead letter queue.
+func (c *Consumer) fail(ctx context.Context, m queue.Message, log *slog.Logger, reporter *jobs.Reporter, cmd command.Command, task command.ConvertTask, err error) {
+	queueName := m.Queue
+	class := command.ErrorClass(err)
+	retries := m.Retries
+
+	log = log.With(
+		slog.String("queue", queueName),
+		slog.String("command", task.Command),
+		slog.String("class", class),
+		slog.Int("retries", retries),
+	)
+
+	if delay, ok := retryDelay(c.cfg.Retry, class, retries); ok {
+		if rErr := c.queue.Retry(ctx, m, delay); rErr != nil {
+			log.Error("failed to schedule retry. Requeue", sl.Err(rErr))
+			_ = m.Requeue()
+			metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeRequeue).Inc()
+			return
+		}
+		log.Warn("failed to exec command. Retry", slog.Duration("delay", delay), sl.Err(err))
+		reporter.Report(jobs.Event{
+			JobID:  task.RequestID,
+			Status: jobs.StatusRetrying,
+			Error:  err.Error(),
+		})
+		_ = m.Ack()
+		metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeRetry).Inc()
+		return
+	}
+
+	if errors.Is(err, netguard.ErrBlocked) {
+		log.Warn("blocked request to forbidden destination", sl.Err(err))
+	} else {
+		log.Error("failed to exec command", sl.Err(err))
+	}
+	if fErr := cmd.Fail(ctx, err); fErr != nil {
+		log.Error("failed to notify portal about the failure", sl.Err(fErr))
+	}
+	reporter.Report(jobs.Event{
+		JobID:  task.RequestID,
+		Status: jobs.StatusFailed,
+		Error:  err.Error(),
+	})
+	_ = m.Reject()
+	metrics.Consumed.WithLabelValues(queueName, metrics.OutcomeReject).Inc()
+}
+
+// retryDelay returns the backoff before the next attempt: the class backoff doubled
+// on every retry and capped by MaxBackoff, 0 means no cap. ok is false when no attempts are left.
+func retryDelay(cfg config.RetryConfig, class string, retries int) (delay time.Duration, ok bool) {
+	if retries+1 >= cfg.MaxAttempts[class] {
+		return 0, false
+	}
+	delay = max(cfg.Backoff[class], time.Second)
+	for i := 0; i < retries && delay <= math.MaxInt64/2; i++ {
+		if cfg.MaxBackoff > 0 && delay >= cfg.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if cfg.MaxBackoff > 0 {
+		delay = min(delay, cfg.MaxBackoff)
+	}
+	return delay, true
+}
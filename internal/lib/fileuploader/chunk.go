@@ -0,0 +1,80 @@
+package fileuploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+// chunk is one part of a file upload. Only the multipart framing is kept in memory,
+// the content is read from the file by every attempt, so a retry sends the whole chunk again.
+type chunk struct {
+	file        *os.File
+	offset      int64
+	size        int64
+	head        []byte
+	tail        []byte
+	contentType string
+}
+
+type field struct {
+	name  string
+	value string
+}
+
+// newChunk frames size bytes of the file starting at offset as the "file" part of a form
+// followed by fields.
+func newChunk(file *os.File, offset int64, size int64, fields []field) (*chunk, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	if _, err := w.CreateFormFile("file", file.Name()); err != nil {
+		return nil, fmt.Errorf("error create form file [%s]: [%w]", file.Name(), err)
+	}
+	head := bytes.Clone(buf.Bytes())
+	buf.Reset()
+
+	for _, fd := range fields {
+		if err := w.WriteField(fd.name, fd.value); err != nil {
+			return nil, fmt.Errorf("error write %s in form [%s]: [%w]", fd.name, fd.value, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error close form file: [%w]", err)
+	}
+
+	return &chunk{
+		file:        file,
+		offset:      offset,
+		size:        size,
+		head:        head,
+		tail:        bytes.Clone(buf.Bytes()),
+		contentType: w.FormDataContentType(),
+	}, nil
+}
+
+func (c *chunk) body() io.ReadCloser {
+	return io.NopCloser(io.MultiReader(
+		bytes.NewReader(c.head),
+		io.NewSectionReader(c.file, c.offset, c.size),
+		bytes.NewReader(c.tail),
+	))
+}
+
+// request builds a request with a fresh body, GetBody lets the client rewind it on a redirect.
+func (c *chunk) request(ctx context.Context, rawUrl string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", rawUrl, c.body())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(c.head)) + c.size + int64(len(c.tail))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return c.body(), nil
+	}
+	req.Header.Set("Content-Type", c.contentType)
+	return req, nil
+}
@@ -0,0 +1,144 @@
+package fileuploader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headlessTTL is how long downloads from a host that failed a HEAD request go straight to GET,
+// after it HEAD is tried again in case the host was fixed.
+const headlessTTL = time.Hour
+
+// headless maps the hosts that rejected a HEAD request, which GET then downloaded, to the time it happened.
+var headless sync.Map
+
+// errHeadRejected is a HEAD request the host answered, but not in a way that tells the size and the type.
+// Timeouts and lost connections are not rejections, the host is tried with HEAD again next time.
+var errHeadRejected = errors.New("head request rejected")
+
+func skipHead(host string) bool {
+	v, ok := headless.Load(host)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) > headlessTTL {
+		headless.Delete(host)
+		return false
+	}
+	return true
+}
+
+// rememberHeadless also forgets the hosts remembered longer than headlessTTL ago,
+// so hosts that are never downloaded from again do not stay in the map.
+func rememberHeadless(host string) {
+	if host == "" {
+		return
+	}
+	headless.Range(func(k, v any) bool {
+		if time.Since(v.(time.Time)) > headlessTTL {
+			headless.Delete(k)
+		}
+		return true
+	})
+	headless.Store(host, time.Now())
+}
+
+// rejectsHead reports whether the status means the server does not serve HEAD for the file.
+func rejectsHead(status int) bool {
+	switch status {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+func hostname(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// checkSize checks the size of the file reported by the server, 0 if it is unknown.
+func checkSize(fileSize int64, maxSize int64, expectedSize int64) error {
+	if fileSize > maxSize {
+		return fmt.Errorf("%w [%d]", ErrFileTooBig, fileSize)
+	}
+	if expectedSize > 0 && fileSize > 0 && fileSize != expectedSize {
+		return fmt.Errorf("%w: server reports [%d], expected [%d]", ErrUnexpectedSize, fileSize, expectedSize)
+	}
+	return nil
+}
+
+// resumeOffset returns the size of the partial file left by an earlier attempt if it can be resumed:
+// it was downloaded with the same validator and is shorter than the file.
+func (f *FileUploader) resumeOffset(filePath string, validator string, fileSize int64) int64 {
+	if validator == "" || f.partials[filePath] != validator {
+		return 0
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+	if fileSize > 0 && info.Size() >= fileSize {
+		return 0
+	}
+	return info.Size()
+}
+
+// rangeValidator returns the value for If-Range: a strong ETag or Last-Modified.
+// Without it the server cannot tell whether the partial file is still valid, so nothing is resumed.
+func rangeValidator(h http.Header) string {
+	if h.Get("Accept-Ranges") == "none" {
+		return ""
+	}
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// contentLength returns the Content-Length header or 0 if it is unknown.
+func contentLength(h http.Header) int64 {
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// contentRange parses "bytes first-last/total", total is 0 if the server does not know it.
+func contentRange(value string) (first int64, total int64, ok bool) {
+	rest, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, size, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, 0, false
+	}
+	from, _, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return first, total, true
+}
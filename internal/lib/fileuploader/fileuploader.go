@@ -1,29 +1,51 @@
 package fileuploader
 
 import (
-	"bytes"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/netguard"
+	"bitrix-converter/internal/lib/tracing"
+	"bitrix-converter/internal/lib/util"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/google/go-querystring/query"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"math"
-	"mime/multipart"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
-	"time"
 	"strings"
+	"sync"
+	"time"
+)
+
+// responseLimit caps the answer of the portal, it is a short JSON.
+const responseLimit = 1 << 20
+
+var (
+	ErrFileTooBig     = errors.New("file is too big")
+	ErrDownloadStatus = errors.New("wrong http-status")
+	ErrContentType    = errors.New("content-type header is empty")
+	ErrSizeMismatch   = errors.New("file size mismatch")
+	// ErrUnexpectedSize is a file that is not of the size given by the task, another attempt gets the same file.
+	ErrUnexpectedSize = errors.New("file size differs from the task")
 )
 
 type FileUploader struct {
 	url           string
+	guard         *netguard.Guard
 	files         map[string]string
 	uploadedFiles map[string]string
 	filesToDelete []string
+	state         *State
+	key           string
+	parallelism   int
+	partials      map[string]string
 }
 
 type uploadInfoResp struct {
@@ -38,28 +60,59 @@ type uploadInfoRequest struct {
 	Upload   string `url:"upload"`
 }
 
+// response is the answer of the portal, a failed request has an error.
 type response struct {
-	success *string
-	error   *string
+	Success any `json:"success,omitempty"`
+	Error   any `json:"error,omitempty"`
 }
 
-func New(url string) *FileUploader {
+func New(url string, guard *netguard.Guard) *FileUploader {
 	return &FileUploader{
 		url:           url,
+		guard:         guard,
 		files:         make(map[string]string),
 		uploadedFiles: make(map[string]string),
 		filesToDelete: make([]string, 0),
+		partials:      make(map[string]string),
 	}
 }
 
+// Retryable reports whether a failed request may succeed on another attempt. Requests to forbidden
+// destinations, files over the size limit and files of another size than the task expects are never retried.
+func Retryable(err error) bool {
+	return !errors.Is(err, netguard.ErrBlocked) && !errors.Is(err, ErrFileTooBig) && !errors.Is(err, ErrUnexpectedSize)
+}
+
 func (f *FileUploader) SetFiles(files map[string]string) {
 	f.files = files
 }
 
+// SetParallelism limits the number of files uploaded at the same time.
+func (f *FileUploader) SetParallelism(n int) {
+	f.parallelism = n
+}
+
+// SetState makes uploads of the task resumable, key identifies the task across deliveries.
+func (f *FileUploader) SetState(state *State, key string) {
+	f.state = state
+	f.key = key
+}
+
+// Resume returns the converted files of an interrupted upload of the task, keyed by format,
+// or nil when the task has to be converted.
+func (f *FileUploader) Resume() map[string]string {
+	return f.state.resume(f.key)
+}
+
 func (f *FileUploader) Files() map[string]string {
 	return f.files
 }
 
+// UploadedFiles returns the names the portal gave to uploaded files, keyed by format.
+func (f *FileUploader) UploadedFiles() map[string]string {
+	return f.uploadedFiles
+}
+
 func (f *FileUploader) urlEncode(str string) (string, error) {
 	u, err := url.Parse(str)
 	if err != nil {
@@ -68,115 +121,219 @@ func (f *FileUploader) urlEncode(str string) (string, error) {
 	return u.String(), nil
 }
 
-func (f *FileUploader) Download(url string, filePath string, maxSize int64) error {
-	client := &http.Client{
-		Timeout: time.Minute * 5,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
-		},
-	}
+// Download saves the file at url to filePath. The size and the type of the file are taken from
+// a HEAD request, or from the GET response if HEAD fails; hosts where it failed skip HEAD for a while.
+// A partial file left by a failed attempt is resumed with a Range request while the server reports
+// the same validator (ETag or Last-Modified) for it, If-Range makes the server send the whole file
+// again if it has changed in between. The body is read up to maxSize, the result must match the size
+// reported by the server and expectedSize when it is not 0.
+func (f *FileUploader) Download(ctx context.Context, url string, filePath string, maxSize int64, expectedSize int64) (err error) {
+	ctx, span := tracing.Start(ctx, "fileuploader.Download")
+	start := time.Now()
+	var written int64
+	defer func() {
+		span.SetAttributes(attribute.Int64("bytes", written))
+		tracing.End(span, err)
+		metrics.ObserveTransfer(metrics.DirectionDownload, written, start, err)
+	}()
+
+	client := f.guard.Client(time.Minute * 5)
+
+	url = util.FixInvalidUrlEscapes(url)
+
+	// the partial file is validated by the server with If-Range even without HEAD
+	validator := f.partials[filePath]
+	var fileSize int64
+
+	host := hostname(url)
+	probed := !skipHead(host)
+
+	var head http.Header
+	var headRejected bool
+	if probed {
+		var headUrl string
+		head, headUrl, err = f.probe(ctx, client, url)
+
+		if err != nil && (errors.Is(err, netguard.ErrBlocked) || ctx.Err() != nil) {
+			return err
+		}
 
-    url = f.fixInvalidUrlEscapes(url);
+		// the url is encoded again if HEAD did not find it, GET follows that
+		url = headUrl
+		headRejected = errors.Is(err, errHeadRejected)
 
-	res, err := client.Head(url)
+		// some proxies and signed links reject HEAD, GET tells the size and the type as well
+		if err == nil {
+			fileSize = contentLength(head)
+			validator = rangeValidator(head)
 
+			if err = checkSize(fileSize, maxSize, expectedSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	offset := f.resumeOffset(filePath, validator, fileSize)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("error head request: [%w]", err)
+		return fmt.Errorf("error create new GET request: [%w]", err)
 	}
 
-	if res.StatusCode != http.StatusOK {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
 
-		url, err = f.urlEncode(url)
+	resp, err := client.Do(req)
 
-		if err != nil {
-			return fmt.Errorf("url encoding failed: [%w]", err)
-		}
+	if err != nil {
+		return fmt.Errorf("error downloading file: [%w]", err)
+	}
 
-		res, err = client.Head(url)
+	defer resp.Body.Close()
 
-		if err != nil {
-			return fmt.Errorf("error head request url encoding [%s]: [%w]", url, err)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server sends the whole file if it ignores the range or the file has changed
+		offset = 0
+		if !resp.Uncompressed && resp.ContentLength > 0 {
+			fileSize = resp.ContentLength
 		}
+	case http.StatusPartialContent:
+		first, total, ok := contentRange(resp.Header.Get("Content-Range"))
+		if !ok || first != offset {
+			delete(f.partials, filePath)
+			return fmt.Errorf("%w [%s] content range [%s]", ErrDownloadStatus, resp.Status, resp.Header.Get("Content-Range"))
+		}
+		if total > 0 {
+			fileSize = total
+		}
+	default:
+		delete(f.partials, filePath)
+		return fmt.Errorf("%w [%s] get request", ErrDownloadStatus, resp.Status)
+	}
 
+	if head == nil && resp.Header.Get("Content-Type") == "" {
+		return ErrContentType
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("wrong http-status [%s] head request: [%w]", res.Status, err)
+	if err = checkSize(fileSize, maxSize, expectedSize); err != nil {
+		delete(f.partials, filePath)
+		return err
 	}
 
-	if res.Header.Get("Content-Type") == "" {
-		return errors.New("content-type header in head request is empty")
+	if resp.StatusCode == http.StatusOK {
+		validator = rangeValidator(resp.Header)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
 	}
 
-	contentLen := res.Header.Get("Content-Length")
-	fileSize, err := strconv.ParseInt(contentLen, 10, 64)
+	file, err := os.OpenFile(filePath, flags, 0644)
 
 	if err != nil {
-		fileSize = 0
+		return fmt.Errorf("error creating file [%s]: [%w]", filePath, err)
 	}
 
-	if fileSize == 0 {
-		fileSize = maxSize
-	}
+	defer file.Close()
 
-	if fileSize > maxSize {
-		return fmt.Errorf("file is too big [%d]", fileSize)
+	if validator != "" {
+		f.partials[filePath] = validator
+	} else {
+		delete(f.partials, filePath)
 	}
 
-	isBytesRanges := res.Header.Get("Accept-Ranges") == "bytes"
+	// one byte over the limit is enough to tell the file is too big
+	written, err = io.Copy(file, io.LimitReader(resp.Body, maxSize-offset+1))
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("error create new GET request: [%w]", err)
+	if offset+written > maxSize {
+		delete(f.partials, filePath)
+		return fmt.Errorf("downloaded %w [%d]", ErrFileTooBig, offset+written)
 	}
 
-	if isBytesRanges {
-		req.Header.Add("Range", "bytes=0-"+strconv.FormatInt(fileSize, 10))
+	if err != nil {
+		return fmt.Errorf("error copy file [%s]: [%w]", filePath, err)
 	}
 
-	resp, err := client.Do(req)
+	realFileSize := offset + written
 
-	if err != nil {
-		return fmt.Errorf("error downloading file: [%w]", err)
+	if fileSize > 0 && realFileSize != fileSize {
+		if realFileSize > fileSize {
+			delete(f.partials, filePath)
+		}
+		return fmt.Errorf("downloaded %w: [%d] of [%d]", ErrSizeMismatch, realFileSize, fileSize)
 	}
 
-	defer resp.Body.Close()
+	delete(f.partials, filePath)
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		return fmt.Errorf("wrong http-status [%s] get request: [%w]", resp.Status, err)
+	if expectedSize > 0 && realFileSize != expectedSize {
+		return fmt.Errorf("downloaded %w: [%d], expected [%d]", ErrUnexpectedSize, realFileSize, expectedSize)
 	}
 
-	file, err := os.Create(filePath)
+	if headRejected {
+		rememberHeadless(host)
+	}
+
+	return nil
+}
+
+// probe sends HEAD for the file and returns its headers with the url that answered,
+// the url is encoded again if the server does not find it. The url is returned on failure too.
+// A host that refuses HEAD or answers it without Content-Type fails with errHeadRejected.
+func (f *FileUploader) probe(ctx context.Context, client *http.Client, url string) (http.Header, string, error) {
+	res, err := f.head(ctx, client, url)
 
 	if err != nil {
-		return fmt.Errorf("error creating file [%s]: [%w]", filePath, err)
+		return nil, url, fmt.Errorf("error head request: [%w]", err)
 	}
 
-	if _, err = io.Copy(file, resp.Body); err != nil {
-		return fmt.Errorf("error copy file [%s]: [%w]", filePath, err)
-	}
+	if res.StatusCode != http.StatusOK {
 
-	fileInfo, err := os.Stat(filePath)
+		_ = res.Body.Close()
+
+		var encoded string
+		encoded, err = f.urlEncode(url)
+
+		if err != nil {
+			return nil, url, fmt.Errorf("url encoding failed: [%w]", err)
+		}
+		url = encoded
+
+		res, err = f.head(ctx, client, url)
+
+		if err != nil {
+			return nil, url, fmt.Errorf("error head request url encoding [%s]: [%w]", url, err)
+		}
 
-	if err != nil {
-		return fmt.Errorf("error getting file info [%s]: [%w]", filePath, err)
 	}
 
-	realFileSize := fileInfo.Size()
+	_ = res.Body.Close()
 
-	defer file.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w [%s] head request", ErrDownloadStatus, res.Status)
+		if rejectsHead(res.StatusCode) {
+			err = fmt.Errorf("%w: [%w]", errHeadRejected, err)
+		}
+		return nil, url, err
+	}
 
-	if realFileSize > maxSize {
-		return fmt.Errorf("downloaded file is too big [%d]: [%w]", realFileSize, err)
+	if res.Header.Get("Content-Type") == "" {
+		return nil, url, fmt.Errorf("%w: [%w]", errHeadRejected, ErrContentType)
 	}
 
-	return nil
+	return res.Header, url, nil
 }
 
+// DeleteFiles removes temporary files except the ones kept to resume the upload.
 func (f *FileUploader) DeleteFiles() {
+	kept := f.state.paths(f.key)
 	for _, file := range f.filesToDelete {
+		if kept[file] {
+			continue
+		}
 		_ = os.Remove(file)
 	}
 }
@@ -185,56 +342,120 @@ func (f *FileUploader) AddFileToDelete(file string) {
 	f.filesToDelete = append(f.filesToDelete, file)
 }
 
-func (f *FileUploader) UploadFiles() error {
-	var client = &http.Client{
-		Timeout: time.Minute * 5,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
-		},
+// UploadFiles uploads the files that are not uploaded yet, at most parallelism of them at a time.
+// A file that was partially uploaded before continues from the last acknowledged chunk.
+// The errors of all failed files are joined, Complete may be called only when it returns nil.
+func (f *FileUploader) UploadFiles(ctx context.Context) error {
+	var client = f.guard.Client(time.Minute * 5)
+
+	f.state.begin(f.key, f.files)
+
+	type result struct {
+		format string
+		name   string
+		err    error
 	}
-	for i, file := range f.files {
-		var uploadInfo = &uploadInfoResp{}
 
-		err := retry.Do(
-			func() error {
-				var err error
-				uploadInfo, err = f.getUploadInfo(file, i)
-				return err
-			},
-			retry.Attempts(3),
-			retry.OnRetry(func(n uint, err error) {
-				time.Sleep(1 * time.Second)
-			}),
-		)
+	results := make(chan result, len(f.files))
+	slots := make(chan struct{}, max(f.parallelism, 1))
+	var wg sync.WaitGroup
 
-		if err != nil {
-			return fmt.Errorf("error creating file [%s]: [%w]", file, err)
-		}
+	for format, file := range f.files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results <- result{format: format, err: fmt.Errorf("error upload file [%s]: [%w]", file, ctx.Err())}
+				return
+			}
+			defer func() {
+				<-slots
+			}()
 
-		f.uploadedFiles[i] = uploadInfo.Name
+			name, err := f.uploadOne(ctx, client, format, file)
+			results <- result{format: format, name: name, err: err}
+		}()
+	}
 
-		err = f.uploadFile(client, file, uploadInfo)
+	wg.Wait()
+	close(results)
 
-		if err != nil {
-			return fmt.Errorf("error upload file [%s]: [%w]", file, err)
+	var errs []error
+	for r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
 		}
+		f.uploadedFiles[r.format] = r.name
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (f *FileUploader) uploadFile(client *http.Client, filePath string, uploadInfo *uploadInfoResp) error {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
+// uploadOne uploads the file of the format and returns the name the portal gave it.
+func (f *FileUploader) uploadOne(ctx context.Context, client *http.Client, format string, file string) (string, error) {
+	if fs, ok := f.state.file(f.key, format); ok && fs.Name != "" {
+		if fs.Done {
+			return fs.Name, nil
+		}
+		uploadInfo := &uploadInfoResp{Bucket: fs.Bucket, Name: fs.Name, ChunkSize: fs.ChunkSize}
+		if err := f.uploadFile(ctx, client, format, file, uploadInfo, fs.Uploaded); err != nil {
+			return "", fmt.Errorf("error upload file [%s]: [%w]", file, err)
+		}
+		return fs.Name, nil
+	}
+
+	var uploadInfo = &uploadInfoResp{}
+
+	err := retry.Do(
+		func() error {
+			var err error
+			uploadInfo, err = f.getUploadInfo(ctx, file, format)
+			return err
+		},
+		retry.Attempts(3),
+		retry.RetryIf(Retryable),
+		retry.LastErrorOnly(true),
+		retry.Context(ctx),
+		retry.OnRetry(func(n uint, err error) {
+			time.Sleep(1 * time.Second)
+		}),
+	)
 
+	if err != nil {
+		return "", fmt.Errorf("error creating file [%s]: [%w]", file, err)
+	}
+
+	f.state.update(f.key, format, func(fs *fileState) {
+		fs.Bucket = uploadInfo.Bucket
+		fs.Name = uploadInfo.Name
+		fs.ChunkSize = uploadInfo.ChunkSize
+		fs.Uploaded = 0
+	})
+
+	err = f.uploadFile(ctx, client, format, file, uploadInfo, 0)
+
+	if err != nil {
+		return "", fmt.Errorf("error upload file [%s]: [%w]", file, err)
+	}
+	return uploadInfo.Name, nil
+}
+
+// uploadFile sends the file in chunks of uploadInfo.ChunkSize starting at offset from. Every attempt reads
+// its chunk from disk again, so at most one chunk of framing is held in memory and retries never send
+// a consumed body. Every acknowledged chunk is recorded in the state.
+func (f *FileUploader) uploadFile(ctx context.Context, client *http.Client, format string, filePath string, uploadInfo *uploadInfoResp, from int64) error {
 	file, err := os.Open(filePath)
 
 	if err != nil {
 		return fmt.Errorf("error open file [%s]: [%w]", filePath, err)
 	}
 
-	fileInfo, err := os.Stat(filePath)
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
 
 	if err != nil {
 		return fmt.Errorf("error get file stat [%s]: [%w]", filePath, err)
@@ -248,152 +469,153 @@ func (f *FileUploader) uploadFile(client *http.Client, filePath string, uploadIn
 
 	parts := int(math.Ceil(float64(dataLength) / float64(uploadInfo.ChunkSize)))
 
-	isLastPart := "n"
-
 	if parts == 0 {
 		parts = 1
 	}
 
-	buffer := make([]byte, uploadInfo.ChunkSize)
-
-	for i := 1; i <= parts; i++ {
+	for i := int(from/uploadInfo.ChunkSize) + 1; i <= parts; i++ {
 
+		isLastPart := "n"
 		if i == parts {
 			isLastPart = "y"
 		}
 
-		bytesRead, err := file.Read(buffer)
+		offset := int64(i-1) * uploadInfo.ChunkSize
+		size := min(uploadInfo.ChunkSize, dataLength-offset)
 
-		if err != nil {
-			if err != io.EOF {
-				return fmt.Errorf("read file to the end [%s]: [%w]", filePath, err)
-			}
-			return fmt.Errorf("error read file [%s]: [%w]", filePath, err)
-		}
-
-		fw, err := w.CreateFormFile("file", file.Name())
-
-		if err != nil {
-			return fmt.Errorf("error create form file [%s]: [%w]", filePath, err)
-		}
-
-		if _, err = fw.Write(buffer[:bytesRead]); err != nil {
-			return fmt.Errorf("error copy file to writer [%s]: [%w]", filePath, err)
-		}
-
-		err = w.WriteField("file_name", uploadInfo.Name)
-
-		if err != nil {
-			return fmt.Errorf("error write file_name in form [%s]: [%w]", uploadInfo.Name, err)
+		fields := []field{
+			{name: "file_name", value: uploadInfo.Name},
+			{name: "last_part", value: isLastPart},
+			{name: "file_size", value: strconv.FormatInt(dataLength, 10)},
 		}
-
-		err = w.WriteField("last_part", isLastPart)
-
-		if err != nil {
-			return fmt.Errorf("error write last_part in form [%s]: [%w]", isLastPart, err)
-		}
-
-		strFileSize := strconv.FormatInt(fileInfo.Size(), 10)
-
-		err = w.WriteField("file_size", strFileSize)
-
-		if err != nil {
-			return fmt.Errorf("error write last_part in form [%s]: [%w]", strFileSize, err)
-		}
-
-		strBucket := strconv.Itoa(uploadInfo.Bucket)
-
 		if uploadInfo.Bucket > 0 {
-			err = w.WriteField("bucket", strBucket)
-			if err != nil {
-				return fmt.Errorf("error write bucket in form [%s]: [%w]", strBucket, err)
-			}
+			fields = append(fields, field{name: "bucket", value: strconv.Itoa(uploadInfo.Bucket)})
 		}
 
-		err = w.Close()
+		c, err := newChunk(file, offset, size, fields)
 
 		if err != nil {
-			return fmt.Errorf("error close form file: [%w]", err)
-		}
-
-		req, err := http.NewRequest("POST", f.url, &buf)
-
-		if err != nil {
-			return fmt.Errorf("error new request upload file to url [%s]: [%w]", f.url, err)
+			return err
 		}
 
-		req.Header.Set("Content-Type", w.FormDataContentType())
-
-		var res = &http.Response{}
+		_, span := tracing.Start(ctx, "fileuploader.uploadChunk", trace.WithAttributes(
+			attribute.String("file_name", uploadInfo.Name),
+			attribute.Int("part", i),
+			attribute.Int("parts", parts),
+			attribute.Int64("bytes", size),
+		))
+		start := time.Now()
 
+		var body []byte
 		err = retry.Do(
 			func() error {
-				res, err = client.Do(req)
-				if err != nil {
-					return fmt.Errorf("error upload file to url [%s]: [%w]", f.url, err)
-				}
-
-				if res.StatusCode != http.StatusOK {
-					return fmt.Errorf("bad status [%s] upload file to url [%s]: [%w]", res.Status, f.url, err)
-				}
+				var err error
+				body, err = f.uploadChunk(ctx, client, c)
 				return err
 			},
 			retry.Attempts(3),
+			retry.RetryIf(Retryable),
+			retry.LastErrorOnly(true),
+			retry.Context(ctx),
 			retry.OnRetry(func(n uint, err error) {
 				time.Sleep(1 * time.Second)
 			}),
 		)
 
+		metrics.ObserveTransfer(metrics.DirectionUpload, size, start, err)
+		tracing.End(span, err)
+
 		if err != nil {
 			return err
 		}
 
 		uploadFileRes := response{}
 
-		body, err := io.ReadAll(res.Body)
-
-		if err != nil {
-			return fmt.Errorf("wrong response upload file to url [%s]: [%w]", f.url, err)
-		}
-
 		if err = json.Unmarshal(body, &uploadFileRes); err != nil {
 			return fmt.Errorf("error unmarshal response upload file to url [%s]: [%w]", f.url, err)
 		}
 
-		if uploadFileRes.error != nil {
-			return fmt.Errorf("error when uploading file to url [%s] [%s]: [%w]", f.url, uploadFileRes.error, err)
+		if uploadFileRes.Error != nil {
+			return fmt.Errorf("error when uploading file to url [%s]: [%v]", f.url, uploadFileRes.Error)
 		}
 
+		f.state.accepted(f.key, format, offset+size, i == parts)
 	}
 
 	return nil
 }
 
-func (f *FileUploader) Complete() error {
+// uploadChunk makes one attempt to send the chunk and returns the response body.
+func (f *FileUploader) uploadChunk(ctx context.Context, client *http.Client, c *chunk) ([]byte, error) {
+	req, err := c.request(ctx, f.url)
+
+	if err != nil {
+		return nil, fmt.Errorf("error new request upload file to url [%s]: [%w]", f.url, err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error upload file to url [%s]: [%w]", f.url, err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status [%s] upload file to url [%s]", res.Status, f.url)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, responseLimit))
+
+	if err != nil {
+		return nil, fmt.Errorf("wrong response upload file to url [%s]: [%w]", f.url, err)
+	}
+
+	return body, nil
+}
+
+func (f *FileUploader) Complete(ctx context.Context) error {
 	queryValues := url.Values{}
 	queryValues.Add("finish", "y")
 
 	for k, file := range f.uploadedFiles {
 		queryValues.Add("result[files]["+k+"]", file)
 	}
-	client := &http.Client{
-		Timeout: time.Second * 30,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
-		},
+
+	if err := f.finish(ctx, queryValues); err != nil {
+		return err
 	}
+	f.state.forget(f.key, false)
+	return nil
+}
+
+// Fail finishes the task on the portal with an error, so Bitrix24 stops waiting for the result.
+// The files kept to resume the upload are deleted, the task will not come back.
+func (f *FileUploader) Fail(ctx context.Context, code int, msg string) error {
+	defer f.state.forget(f.key, true)
+
+	queryValues := url.Values{}
+	queryValues.Add("finish", "y")
+	queryValues.Add("error", msg)
+	queryValues.Add("errorCode", strconv.Itoa(code))
+
+	return f.finish(ctx, queryValues)
+}
+
+func (f *FileUploader) finish(ctx context.Context, queryValues url.Values) error {
+	client := f.guard.Client(time.Second * 30)
 
 	var res = &http.Response{}
 
 	err := retry.Do(
 		func() error {
 			var err error
-			res, err = client.PostForm(f.url, queryValues)
+			res, err = f.postForm(ctx, client, f.url, queryValues)
 			return err
 		},
 		retry.Attempts(3),
+		retry.RetryIf(Retryable),
+		retry.LastErrorOnly(true),
+		retry.Context(ctx),
 		retry.OnRetry(func(n uint, err error) {
 			time.Sleep(1 * time.Second)
 		}),
@@ -403,13 +625,15 @@ func (f *FileUploader) Complete() error {
 		return fmt.Errorf("error send complete request to url [%s]: [%w]", f.url, err)
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status %s complete request to url [%s]: [%w]", res.Status, f.url, err)
+		return fmt.Errorf("bad status [%s] complete request to url [%s]", res.Status, f.url)
 	}
 
 	completeRes := response{}
 
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, responseLimit))
 
 	if err != nil {
 		return fmt.Errorf("wrong response complete request to url [%s]: [%w]", f.url, err)
@@ -419,14 +643,14 @@ func (f *FileUploader) Complete() error {
 		return fmt.Errorf("error unmarshal complete request to url [%s]: [%w]", f.url, err)
 	}
 
-	if completeRes.error != nil {
-		return fmt.Errorf("error complete request to url [%s] [%s]: [%w]", f.url, completeRes.error, err)
+	if completeRes.Error != nil {
+		return fmt.Errorf("error complete request to url [%s]: [%v]", f.url, completeRes.Error)
 	}
 
 	return nil
 }
 
-func (f *FileUploader) getUploadInfo(file string, key string) (*uploadInfoResp, error) {
+func (f *FileUploader) getUploadInfo(ctx context.Context, file string, key string) (*uploadInfoResp, error) {
 	fileInfo, err := os.Stat(file)
 
 	if err != nil {
@@ -445,15 +669,21 @@ func (f *FileUploader) getUploadInfo(file string, key string) (*uploadInfoResp,
 		return nil, fmt.Errorf("error convert struct request to query: [%w]", err)
 	}
 
-	res, err := http.PostForm(f.url, v)
+	res, err := f.postForm(ctx, f.guard.Client(time.Second*30), f.url, v)
 
 	if err != nil {
 		return nil, fmt.Errorf("error get upload info from [%s]: [%w]", f.url, err)
 	}
 
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status [%s] upload info request to url [%s]", res.Status, f.url)
+	}
+
 	var uploadInfoRes uploadInfoResp
 
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, responseLimit))
 
 	if err != nil {
 		return nil, fmt.Errorf("wrong response upload info request to url [%s]: [%w]", f.url, err)
@@ -466,24 +696,19 @@ func (f *FileUploader) getUploadInfo(file string, key string) (*uploadInfoResp,
 	return &uploadInfoRes, nil
 }
 
-func (f *FileUploader) fixInvalidUrlEscapes(u string) string {
-    var sb strings.Builder
-    for i := 0; i < len(u); i++ {
-        if u[i] == '%' {
-            if i+2 < len(u) && f.isHex(u[i+1]) && f.isHex(u[i+2]) {
-                sb.WriteByte(u[i])
-            } else {
-                sb.WriteString("%25")
-            }
-        } else {
-            sb.WriteByte(u[i])
-        }
-    }
-    return sb.String()
+func (f *FileUploader) head(ctx context.Context, client *http.Client, rawUrl string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
 }
 
-func (f *FileUploader) isHex(b byte) bool {
-    return (b >= '0' && b <= '9') ||
-        (b >= 'a' && b <= 'f') ||
-        (b >= 'A' && b <= 'F')
-}
\ No newline at end of file
+func (f *FileUploader) postForm(ctx context.Context, client *http.Client, rawUrl string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", rawUrl, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
@@ -0,0 +1,392 @@
+package fileuploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// part is one request the fake portal received.
+type part struct {
+	contentLength int64
+	body          []byte
+	fields        map[string]string
+	file          []byte
+}
+
+// portal is a fake Bitrix24 upload endpoint. It records every request and answers
+// the attempts listed in fail with 500.
+type portal struct {
+	mu    sync.Mutex
+	parts []part
+	fail  []int
+}
+
+func (p *portal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	got := part{contentLength: r.ContentLength, body: body, fields: make(map[string]string)}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, _ := io.ReadAll(p)
+		if p.FormName() == "file" {
+			got.file = value
+			continue
+		}
+		got.fields[p.FormName()] = string(value)
+	}
+
+	p.mu.Lock()
+	p.parts = append(p.parts, got)
+	attempt := len(p.parts)
+	p.mu.Unlock()
+
+	if slices.Contains(p.fail, attempt) {
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"success":true}`))
+}
+
+func upload(t *testing.T, p *portal, content string, info *uploadInfoResp) {
+	t.Helper()
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(srv.URL, nil)
+	if err := f.uploadFile(context.Background(), f.guard.Client(time.Minute), "pdf", path, info, 0); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+}
+
+func TestUploadFileRetriesWholeChunk(t *testing.T) {
+	p := &portal{fail: []int{2}}
+	upload(t, p, "0123456789", &uploadInfoResp{Bucket: 7, Name: "doc.pdf", ChunkSize: 4})
+
+	if len(p.parts) != 4 {
+		t.Fatalf("portal got %d requests, want 4", len(p.parts))
+	}
+
+	failed, retried := p.parts[1], p.parts[2]
+	if failed.contentLength != retried.contentLength || failed.contentLength != int64(len(retried.body)) {
+		t.Errorf("retry Content-Length %d, failed attempt %d, body %d bytes",
+			retried.contentLength, failed.contentLength, len(retried.body))
+	}
+	if !bytes.Equal(failed.body, retried.body) {
+		t.Error("retry did not send the same chunk again")
+	}
+
+	accepted := []part{p.parts[0], p.parts[2], p.parts[3]}
+	want := []struct {
+		file     string
+		lastPart string
+	}{
+		{"0123", "n"},
+		{"4567", "n"},
+		{"89", "y"},
+	}
+	for i, w := range want {
+		got := accepted[i]
+		if string(got.file) != w.file {
+			t.Errorf("chunk %d: file %q, want %q", i, got.file, w.file)
+		}
+		if got.contentLength != int64(len(got.body)) {
+			t.Errorf("chunk %d: Content-Length %d, body %d bytes", i, got.contentLength, len(got.body))
+		}
+		expected := map[string]string{
+			"file_name": "doc.pdf",
+			"last_part": w.lastPart,
+			"file_size": "10",
+			"bucket":    "7",
+		}
+		for name, value := range expected {
+			if got.fields[name] != value {
+				t.Errorf("chunk %d: %s %q, want %q", i, name, got.fields[name], value)
+			}
+		}
+	}
+}
+
+func TestUploadFileEmpty(t *testing.T) {
+	p := &portal{}
+	upload(t, p, "", &uploadInfoResp{Name: "empty.pdf", ChunkSize: 4})
+
+	if len(p.parts) != 1 {
+		t.Fatalf("portal got %d requests, want 1", len(p.parts))
+	}
+	got := p.parts[0]
+	if len(got.file) != 0 {
+		t.Errorf("file %q, want empty", got.file)
+	}
+	if got.fields["last_part"] != "y" || got.fields["file_size"] != "0" {
+		t.Errorf("last_part %q, file_size %q, want y and 0", got.fields["last_part"], got.fields["file_size"])
+	}
+	if _, ok := got.fields["bucket"]; ok {
+		t.Error("bucket sent without one")
+	}
+}
+
+func TestUploadChunkLimitsResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte(`{"success":"` + strings.Repeat("y", responseLimit) + `"}`))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	c, err := newChunk(file, 0, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(srv.URL, nil)
+	body, err := f.uploadChunk(context.Background(), f.guard.Client(time.Minute), c)
+	if err != nil {
+		t.Fatalf("upload chunk: %v", err)
+	}
+	if len(body) != responseLimit {
+		t.Fatalf("read %d bytes of the response, want %d", len(body), responseLimit)
+	}
+}
+
+func TestPortalRequestsCheckStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		ok     bool
+	}{
+		{http.StatusOK, `{"success":true,"bucket":1,"name":"doc.pdf","chunk_size":4}`, true},
+		{http.StatusBadGateway, `{"success":true,"bucket":1,"name":"doc.pdf","chunk_size":4}`, false},
+		{http.StatusNotFound, `not found`, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			path := filepath.Join(t.TempDir(), "doc.pdf")
+			if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			f := New(srv.URL, nil)
+			if _, err := f.getUploadInfo(context.Background(), path, "pdf"); (err == nil) != tt.ok {
+				t.Errorf("upload info: %v", err)
+			}
+			if err := f.finish(context.Background(), url.Values{"finish": {"y"}}); (err == nil) != tt.ok {
+				t.Errorf("finish: %v", err)
+			}
+		})
+	}
+}
+
+// origin is a fake file host. It serves content with the ETag etag through http.ServeContent,
+// which answers HEAD, Range and If-Range, and records the headers of every GET.
+// With rejectHead it answers HEAD with 405.
+type origin struct {
+	mu         sync.Mutex
+	content    string
+	etag       string
+	rejectHead bool
+	heads      int
+	gets       []http.Header
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	if r.Method == http.MethodHead {
+		o.heads++
+	} else {
+		o.gets = append(o.gets, r.Header.Clone())
+	}
+	o.mu.Unlock()
+
+	if r.Method == http.MethodHead && o.rejectHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Content-Type", "application/pdf")
+	http.ServeContent(w, r, "doc.pdf", time.Time{}, strings.NewReader(o.content))
+}
+
+// serve starts a server for the origin, the host is forgotten as headless afterwards.
+func serve(t *testing.T, o *origin) string {
+	t.Helper()
+
+	srv := httptest.NewServer(o)
+	t.Cleanup(func() {
+		srv.Close()
+		headless.Delete(hostname(srv.URL))
+	})
+	return srv.URL + "/doc.pdf"
+}
+
+// partial leaves the beginning of a file as a failed attempt downloaded with validator does.
+func partial(t *testing.T, f *FileUploader, content string, validator string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.partials[path] = validator
+	return path
+}
+
+func TestDownloadIfRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		etag       string
+		rejectHead bool
+		ranged     bool
+		want       string
+	}{
+		// HEAD reports the validator of the partial file, the server answers 206 with the rest
+		{"same file", "0123456789", `"v1"`, false, true, "ABCD456789"},
+		// HEAD reports another validator, the file is downloaded from the start
+		{"changed file", "abcdefghij", `"v2"`, false, false, "abcdefghij"},
+		// without HEAD the range is requested and If-Range makes the server answer 200 with the new file
+		{"changed file without head", "abcdefghij", `"v2"`, true, true, "abcdefghij"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &origin{content: tt.content, etag: tt.etag, rejectHead: tt.rejectHead}
+			link := serve(t, o)
+
+			f := New("", nil)
+			// the partial file differs from the origin, so the result tells 206 from 200
+			path := partial(t, f, "ABCD", `"v1"`)
+
+			if err := f.Download(context.Background(), link, path, 100, int64(len(tt.content))); err != nil {
+				t.Fatalf("download: %v", err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("file %q, want %q", got, tt.want)
+			}
+			if _, ok := f.partials[path]; ok {
+				t.Error("complete file is still kept as partial")
+			}
+
+			if len(o.gets) != 1 {
+				t.Fatalf("origin got %d GET requests, want 1", len(o.gets))
+			}
+			header := o.gets[0]
+			if !tt.ranged {
+				if header.Get("Range") != "" {
+					t.Errorf("range %q requested for a changed file", header.Get("Range"))
+				}
+				return
+			}
+			if header.Get("Range") != "bytes=4-" || header.Get("If-Range") != `"v1"` {
+				t.Errorf("Range %q, If-Range %q, want bytes=4- and \"v1\"", header.Get("Range"), header.Get("If-Range"))
+			}
+		})
+	}
+}
+
+func TestDownloadUnexpectedSize(t *testing.T) {
+	for _, rejectHead := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reject head %v", rejectHead), func(t *testing.T) {
+			o := &origin{content: "0123456789", etag: `"v1"`, rejectHead: rejectHead}
+			link := serve(t, o)
+
+			f := New("", nil)
+			path := filepath.Join(t.TempDir(), "doc.pdf")
+
+			err := f.Download(context.Background(), link, path, 100, 8)
+			if !errors.Is(err, ErrUnexpectedSize) {
+				t.Fatalf("got %v, want %v", err, ErrUnexpectedSize)
+			}
+			if Retryable(err) {
+				t.Error("file of another size is retried")
+			}
+			if !rejectHead && len(o.gets) != 0 {
+				t.Error("file downloaded after HEAD reported another size")
+			}
+		})
+	}
+}
+
+func TestDownloadRemembersHeadRejection(t *testing.T) {
+	o := &origin{content: "0123456789", etag: `"v1"`, rejectHead: true}
+	link := serve(t, o)
+
+	f := New("", nil)
+	heads := 0
+	for i := range 2 {
+		path := filepath.Join(t.TempDir(), "doc.pdf")
+		if err := f.Download(context.Background(), link, path, 100, 10); err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+		if i == 0 {
+			heads = o.heads
+		}
+	}
+
+	if heads == 0 || o.heads != heads {
+		t.Errorf("origin got %d HEAD requests by the first download and %d in total, want none by the second", heads, o.heads)
+	}
+	if len(o.gets) != 2 {
+		t.Errorf("origin got %d GET requests, want 2", len(o.gets))
+	}
+	if !skipHead(hostname(link)) {
+		t.Error("host that rejected HEAD is not remembered")
+	}
+}
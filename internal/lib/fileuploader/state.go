@@ -0,0 +1,308 @@
+package fileuploader
+
+import (
+	"bitrix-converter/internal/lib/logger/sl"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var uploadsBucket = []byte("uploads")
+
+// State keeps the progress of uploads in a BoltDB file, so a task delivered again after a crash
+// or a failed upload continues from the last chunk the portal accepted instead of
+// downloading and converting the file again. A nil State keeps nothing.
+type State struct {
+	mu    sync.Mutex
+	log   *slog.Logger
+	db    *bolt.DB
+	path  string
+	ttl   time.Duration
+	tasks map[string]*taskState
+}
+
+type taskState struct {
+	Files     map[string]*fileState `json:"files"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// fileState is the upload of one converted file. Uploaded is the offset of the first chunk
+// the portal has not acknowledged yet.
+type fileState struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Bucket    int    `json:"bucket"`
+	Name      string `json:"name"`
+	ChunkSize int64  `json:"chunk_size"`
+	Uploaded  int64  `json:"uploaded"`
+	Done      bool   `json:"done"`
+}
+
+// OpenState loads the state of this instance: the host name is added to the file name, so consumers
+// sharing a volume do not overwrite each other. Uploads not touched for ttl are dropped with their files.
+func OpenState(log *slog.Logger, path string, ttl time.Duration) (*State, error) {
+	path = instancePath(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload state directory [%s]: [%w]", path, err)
+	}
+
+	// the file is locked while it is open, another process with the same host name waits and fails
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload state [%s]: [%w]", path, err)
+	}
+
+	s := &State{
+		log:   log,
+		db:    db,
+		path:  path,
+		ttl:   ttl,
+		tasks: make(map[string]*taskState),
+	}
+
+	var broken []string
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(uploadsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t taskState
+			if err := json.Unmarshal(v, &t); err != nil {
+				// a broken entry only costs the upload of its task
+				broken = append(broken, string(k))
+				return nil
+			}
+			s.tasks[string(k)] = &t
+			return nil
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to read upload state [%s]: [%w]", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range broken {
+		log.Error("failed to parse upload state of task, start over", slog.String("key", key))
+		s.save(key)
+	}
+	s.prune()
+	return s, nil
+}
+
+// Close closes the state file.
+func (s *State) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// instancePath adds the host name to the file name: uploads.db becomes uploads-<host>.db.
+func instancePath(path string) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + host + ext
+}
+
+// resume returns the files of an interrupted upload of the task when all of them are still on disk.
+func (s *State) resume(key string) map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[key]
+	if !ok || len(t.Files) == 0 {
+		return nil
+	}
+
+	files := make(map[string]string, len(t.Files))
+	for format, fs := range t.Files {
+		info, err := os.Stat(fs.Path)
+		if err != nil || info.Size() != fs.Size {
+			return nil
+		}
+		files[format] = fs.Path
+	}
+	return files
+}
+
+// begin records the files of the task before they are uploaded. The progress of a file
+// is kept only if it is the same file. Nothing is written until a chunk is accepted.
+func (s *State) begin(key string, files map[string]string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+
+	t, ok := s.tasks[key]
+	if !ok {
+		t = &taskState{}
+	}
+	previous := t.Files
+	t.Files = make(map[string]*fileState, len(files))
+
+	for format, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fs, ok := previous[format]; ok && fs.Path == path && fs.Size == info.Size() {
+			t.Files[format] = fs
+			continue
+		}
+		t.Files[format] = &fileState{Path: path, Size: info.Size()}
+	}
+
+	t.UpdatedAt = time.Now()
+	s.tasks[key] = t
+}
+
+func (s *State) file(key string, format string) (fileState, bool) {
+	if s == nil {
+		return fileState{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.fileState(key, format)
+	if !ok {
+		return fileState{}, false
+	}
+	return *fs, true
+}
+
+// update changes the upload of the file in memory, it is written with the next accepted chunk.
+func (s *State) update(key string, format string, fn func(fs *fileState)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fs, ok := s.fileState(key, format); ok {
+		fn(fs)
+	}
+}
+
+// accepted records that the portal acknowledged the chunk ending at uploaded, done is set by the last one.
+func (s *State) accepted(key string, format string, uploaded int64, done bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.fileState(key, format)
+	if !ok {
+		return
+	}
+	fs.Uploaded = uploaded
+	fs.Done = done
+	s.tasks[key].UpdatedAt = time.Now()
+	s.save(key)
+}
+
+func (s *State) fileState(key string, format string) (*fileState, bool) {
+	t, ok := s.tasks[key]
+	if !ok {
+		return nil, false
+	}
+	fs, ok := t.Files[format]
+	return fs, ok
+}
+
+// paths returns the files kept for the upload of the task.
+func (s *State) paths(key string) map[string]bool {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[key]
+	if !ok {
+		return nil
+	}
+	paths := make(map[string]bool, len(t.Files))
+	for _, fs := range t.Files {
+		paths[fs.Path] = true
+	}
+	return paths
+}
+
+// forget drops the upload of the task, removeFiles also deletes the files kept for it.
+func (s *State) forget(key string, removeFiles bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[key]
+	if !ok {
+		return
+	}
+	delete(s.tasks, key)
+	if removeFiles {
+		removeTaskFiles(t)
+	}
+	s.save(key)
+}
+
+// prune drops uploads that were not touched for ttl, their tasks are gone.
+func (s *State) prune() {
+	if s.ttl <= 0 {
+		return
+	}
+	for key, t := range maps.Clone(s.tasks) {
+		if time.Since(t.UpdatedAt) > s.ttl {
+			delete(s.tasks, key)
+			removeTaskFiles(t)
+			s.save(key)
+		}
+	}
+}
+
+// save writes the upload of the task, or deletes it when the task is forgotten.
+func (s *State) save(key string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(uploadsBucket)
+		t, ok := s.tasks[key]
+		if !ok {
+			return b.Delete([]byte(key))
+		}
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+	if err != nil {
+		s.log.Error("failed to save upload state", slog.String("path", s.path), slog.String("key", key), sl.Err(err))
+	}
+}
+
+func removeTaskFiles(t *taskState) {
+	for _, fs := range t.Files {
+		_ = os.Remove(fs.Path)
+	}
+}
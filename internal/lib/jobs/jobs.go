@@ -0,0 +1,119 @@
+package jobs
+
+import (
+	"bitrix-converter/internal/storage"
+	"slices"
+	"time"
+)
+
+// StatusQueue receives job state transitions reported by consumers.
+const StatusQueue = "converter_job_status"
+
+type Status string
+
+const (
+	StatusQueued      Status = "queued"
+	StatusDownloading Status = "downloading"
+	StatusConverting  Status = "converting"
+	StatusUploading   Status = "uploading"
+	StatusRetrying    Status = "retrying"
+	StatusCompleted   Status = "completed"
+	StatusFailed      Status = "failed"
+)
+
+type Job struct {
+	ID         string            `json:"id"`
+	Command    string            `json:"command"`
+	Queue      string            `json:"queue"`
+	File       string            `json:"file"`
+	FileId     int               `json:"file_id,omitempty"`
+	FileSize   int64             `json:"file_size,omitempty"`
+	Priority   uint8             `json:"priority"`
+	BackUrl    string            `json:"back_url"`
+	Formats    []string          `json:"formats"`
+	Status     Status            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Attempts   int               `json:"attempts"`
+	Files      map[string]string `json:"files,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Duration   time.Duration     `json:"duration,omitempty"`
+	History    []Transition      `json:"history"`
+}
+
+// Cursor is the position of the job in a listing.
+func (j Job) Cursor() storage.Cursor {
+	return storage.Cursor{CreatedAt: j.CreatedAt, ID: j.ID}
+}
+
+// Matches reports whether the job is selected by the query, regardless of the limit.
+func (j Job) Matches(q storage.Query) bool {
+	return (q.Status == "" || string(j.Status) == q.Status) && q.After.Follows(j.CreatedAt, j.ID)
+}
+
+// Page orders jobs newest first and keeps the first limit of them, all of them if limit is 0.
+func Page(list []Job, limit int) []Job {
+	slices.SortFunc(list, func(a, b Job) int {
+		return storage.Compare(a.Cursor(), b.Cursor())
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+type Transition struct {
+	Status Status    `json:"status"`
+	Worker string    `json:"worker,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Event is a state transition sent by a consumer through StatusQueue.
+type Event struct {
+	JobID  string            `json:"job_id"`
+	Status Status            `json:"status"`
+	Worker string            `json:"worker,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Files  map[string]string `json:"files,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+func (s Status) Final() bool {
+	return s == StatusCompleted || s == StatusFailed
+}
+
+// apply moves the job to the state described by the event.
+func (j *Job) apply(e Event) {
+	if e.Status == StatusDownloading {
+		j.Attempts++
+		if j.StartedAt == nil {
+			startedAt := e.Time
+			j.StartedAt = &startedAt
+		}
+	}
+
+	if e.Status.Final() {
+		finishedAt := e.Time
+		j.FinishedAt = &finishedAt
+		if j.StartedAt != nil {
+			j.Duration = finishedAt.Sub(*j.StartedAt)
+		}
+	}
+
+	if e.Files != nil {
+		j.Files = e.Files
+	}
+
+	j.Status = e.Status
+	j.Error = e.Error
+	j.UpdatedAt = e.Time
+	j.History = append(j.History, Transition{
+		Status: e.Status,
+		Worker: e.Worker,
+		Error:  e.Error,
+		Time:   e.Time,
+	})
+}
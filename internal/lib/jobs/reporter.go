@@ -0,0 +1,51 @@
+package jobs
+
+import (
+	"bitrix-converter/internal/lib/logger/sl"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, queue string, message []byte) error
+}
+
+// Reporter sends job state transitions from a consumer to the producer.
+// A nil Reporter discards all events.
+type Reporter struct {
+	publisher Publisher
+	log       *slog.Logger
+	worker    string
+}
+
+func NewReporter(publisher Publisher, log *slog.Logger, worker string) *Reporter {
+	return &Reporter{
+		publisher: publisher,
+		log:       log,
+		worker:    worker,
+	}
+}
+
+func (r *Reporter) Report(e Event) {
+	if r == nil || e.JobID == "" {
+		return
+	}
+
+	e.Worker = r.worker
+	e.Time = time.Now()
+
+	msg, err := json.Marshal(e)
+	if err != nil {
+		r.log.Error("failed to encode job status", slog.String("job_id", e.JobID), sl.Err(err))
+		return
+	}
+
+	if err = r.publisher.Publish(context.Background(), StatusQueue, msg); err != nil {
+		r.log.Error("failed to report job status",
+			slog.String("job_id", e.JobID),
+			slog.String("status", string(e.Status)),
+			sl.Err(err))
+	}
+}
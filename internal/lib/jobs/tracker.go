@@ -0,0 +1,166 @@
+package jobs
+
+import (
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/queue"
+	"bitrix-converter/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tracker keeps the state of jobs accepted by the producer.
+type Tracker struct {
+	log   *slog.Logger
+	mu    sync.Mutex
+	store storage.Store[Job]
+}
+
+func NewTracker(log *slog.Logger, store storage.Store[Job]) *Tracker {
+	return &Tracker{
+		log:   log,
+		store: store,
+	}
+}
+
+func (t *Tracker) Create(job Job) error {
+	now := time.Now()
+
+	job.Status = StatusQueued
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	job.History = []Transition{{Status: StatusQueued, Time: now}}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.store.SaveJob(job); err != nil {
+		return fmt.Errorf("failed to save job [%s]: [%w]", job.ID, err)
+	}
+	return nil
+}
+
+func (t *Tracker) Apply(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	job, err := t.store.Job(e.JobID)
+	if errors.Is(err, storage.ErrJobNotFound) {
+		// the job was queued before its history was pruned or the store was replaced
+		job = Job{ID: e.JobID, CreatedAt: e.Time}
+	} else if err != nil {
+		return fmt.Errorf("failed to get job [%s]: [%w]", e.JobID, err)
+	}
+
+	job.apply(e)
+
+	if err = t.store.SaveJob(job); err != nil {
+		return fmt.Errorf("failed to save job [%s]: [%w]", job.ID, err)
+	}
+	return nil
+}
+
+func (t *Tracker) Job(id string) (Job, error) {
+	return t.store.Job(id)
+}
+
+// Jobs returns a page of jobs with the given status, newest first, and the cursor of the next page,
+// which is zero on the last page. An empty status matches any job.
+func (t *Tracker) Jobs(status Status, limit int, after storage.Cursor) ([]Job, storage.Cursor, error) {
+	q := storage.Query{Status: string(status), After: after}
+	if limit > 0 {
+		// one more job tells whether there is a next page
+		q.Limit = limit + 1
+	}
+
+	result, err := t.store.Jobs(q)
+	if err != nil {
+		return nil, storage.Cursor{}, err
+	}
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+		return result, result[limit-1].Cursor(), nil
+	}
+	return result, storage.Cursor{}, nil
+}
+
+// Prune removes jobs older than retention every interval until ctx is canceled.
+func (t *Tracker) Prune(ctx context.Context, retention time.Duration, interval time.Duration) {
+	for {
+		deleted, err := t.store.DeleteJobs(time.Now().Add(-retention))
+		if err != nil {
+			t.log.Error("failed to prune jobs", sl.Err(err))
+		} else if deleted > 0 {
+			t.log.Info("pruned jobs", slog.Int("count", deleted))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Run consumes status events reported by consumers until ctx is canceled.
+// After a failure it resumes as soon as the connection is restored or after 10 seconds.
+func (t *Tracker) Run(ctx context.Context, q queue.Queue) {
+	reconnected := make(chan struct{}, 1)
+	unsubscribe := q.NotifyReconnect(reconnected)
+	defer unsubscribe()
+
+	for {
+		err := t.consume(ctx, q)
+		if err != nil {
+			t.log.Error("failed consume job statuses. Retry after 10 seconds", sl.Err(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-reconnected:
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (t *Tracker) consume(ctx context.Context, q queue.Queue) error {
+	msgs, cancel, err := q.Consume(StatusQueue, queue.ConsumeOptions{})
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-msgs:
+			if !ok {
+				return errors.New("job status channel closed")
+			}
+
+			var e Event
+			if err = json.Unmarshal(m.Body, &e); err != nil {
+				t.log.Error("failed to parse job status", sl.Err(err))
+				_ = m.Reject()
+				continue
+			}
+			if err = t.Apply(e); err != nil {
+				t.log.Error("failed to apply job status", slog.String("job_id", e.JobID), sl.Err(err))
+				_ = m.Reject()
+				continue
+			}
+			_ = m.Ack()
+		}
+	}
+}
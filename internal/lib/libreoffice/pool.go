@@ -0,0 +1,249 @@
+package libreoffice
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/procgroup"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	serverCommand = "unoserver"
+	dialTimeout   = time.Second
+)
+
+var (
+	ErrPoolClosed = errors.New("libreoffice pool is closed")
+)
+
+// Pool keeps long-lived headless LibreOffice instances driven by unoserver.
+// Every instance has its own profile and ports and serves one conversion at a time.
+type Pool struct {
+	log    *slog.Logger
+	cfg    config.LibreofficeConfig
+	idle   chan *Instance
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+type Instance struct {
+	id          int
+	port        int
+	unoPort     int
+	profile     string
+	conversions int
+	broken      bool
+	cmd         *exec.Cmd
+	exited      chan struct{}
+}
+
+func New(log *slog.Logger, cfg config.LibreofficeConfig) *Pool {
+	return &Pool{
+		log:  log.With(slog.String("component", "libreoffice.Pool")),
+		cfg:  cfg,
+		idle: make(chan *Instance, cfg.PoolSize),
+		done: make(chan struct{}),
+	}
+}
+
+// Start launches all instances. Instances that fail to start are retried on the first Acquire.
+func (p *Pool) Start() {
+	for i := 0; i < p.cfg.PoolSize; i++ {
+		inst := &Instance{
+			id:      i,
+			port:    p.cfg.BasePort + i*2,
+			unoPort: p.cfg.BasePort + i*2 + 1,
+			profile: filepath.Join(os.TempDir(), "libreoffice", "pool", strconv.Itoa(i)),
+		}
+		if err := p.start(context.Background(), inst); err != nil {
+			p.log.Error("failed to start libreoffice instance", slog.Int("instance", i), sl.Err(err))
+			inst.broken = true
+		}
+		p.put(inst)
+	}
+}
+
+// Acquire waits for an idle instance and makes sure it is alive before handing it out.
+// A restart of the instance is abandoned when ctx is done, the instance is then restarted on the next Acquire.
+func (p *Pool) Acquire(ctx context.Context) (*Instance, error) {
+	var inst *Instance
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, ErrPoolClosed
+	case inst = <-p.idle:
+	}
+
+	if inst.broken || !p.healthy(inst) || (p.cfg.MaxConversions > 0 && inst.conversions >= p.cfg.MaxConversions) {
+		if err := p.restart(ctx, inst); err != nil {
+			inst.broken = true
+			p.put(inst)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to restart libreoffice instance [%d]: [%w]", inst.id, err)
+		}
+	}
+
+	select {
+	case <-p.done:
+		p.put(inst)
+		return nil, ErrPoolClosed
+	default:
+	}
+	return inst, nil
+}
+
+// Release returns the instance to the pool. An instance that failed a conversion
+// is restarted before it is used again.
+func (p *Pool) Release(inst *Instance, err error) {
+	inst.conversions++
+	if err != nil {
+		inst.broken = true
+	}
+	p.put(inst)
+}
+
+// Close stops the idle instances. Instances in use are stopped when they are released,
+// so a running conversion is not killed and its instance is not touched by two goroutines.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	// nothing is put back after closed is set, so the channel holds every idle instance
+	for {
+		select {
+		case inst := <-p.idle:
+			p.stop(inst)
+		default:
+			return
+		}
+	}
+}
+
+// put makes the instance idle, or stops it if the pool is closed.
+func (p *Pool) put(inst *Instance) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.stop(inst)
+		return
+	}
+	p.idle <- inst
+	p.mu.Unlock()
+}
+
+func (inst *Instance) Port() int {
+	return inst.port
+}
+
+// start launches the server and waits until it accepts connections, StartTimeout at most.
+func (p *Pool) start(ctx context.Context, inst *Instance) error {
+	args := []string{
+		"--interface", "127.0.0.1",
+		"--port", strconv.Itoa(inst.port),
+		"--uno-port", strconv.Itoa(inst.unoPort),
+		"--user-installation", "file://" + inst.profile,
+	}
+
+	cmd := exec.Command(serverCommand, args...)
+	procgroup.Set(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: [%w]", serverCommand, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		select {
+		case <-p.done:
+		default:
+			p.log.Warn("libreoffice instance exited", slog.Int("instance", inst.id), slog.Any("error", err))
+		}
+	}()
+
+	inst.cmd = cmd
+	inst.exited = exited
+	inst.conversions = 0
+	inst.broken = false
+
+	deadline := time.Now().Add(p.cfg.StartTimeout)
+	for time.Now().Before(deadline) {
+		if p.healthy(inst) {
+			p.log.Info("libreoffice instance started", slog.Int("instance", inst.id), slog.Int("port", inst.port))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.stop(inst)
+			return ctx.Err()
+		case <-exited:
+			return fmt.Errorf("%s exited during start", serverCommand)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	p.stop(inst)
+	return fmt.Errorf("%s did not start within [%s]", serverCommand, p.cfg.StartTimeout)
+}
+
+func (p *Pool) restart(ctx context.Context, inst *Instance) error {
+	p.log.Info("restarting libreoffice instance",
+		slog.Int("instance", inst.id),
+		slog.Int("conversions", inst.conversions),
+		slog.Bool("broken", inst.broken))
+
+	p.stop(inst)
+	_ = os.RemoveAll(inst.profile)
+
+	return p.start(ctx, inst)
+}
+
+func (p *Pool) stop(inst *Instance) {
+	if inst.cmd == nil {
+		return
+	}
+	_ = procgroup.Kill(inst.cmd)
+	<-inst.exited
+	inst.cmd = nil
+}
+
+// healthy checks that the server process is running and accepts connections.
+func (p *Pool) healthy(inst *Instance) bool {
+	if inst.cmd == nil {
+		return false
+	}
+	select {
+	case <-inst.exited:
+		return false
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(inst.port)), dialTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bitrix-converter/internal/lib/logger/sl"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	namespace = "converter"
+
+	ToolLibreoffice = "libreoffice"
+	ToolImageMagick = "imagemagick"
+	ToolFfmpeg      = "ffmpeg"
+	ToolPdfToText   = "pdftotext"
+
+	OutcomeAck     = "ack"
+	OutcomeReject  = "reject"
+	OutcomeRequeue = "requeue"
+	OutcomeRetry   = "retry"
+
+	DirectionDownload = "download"
+	DirectionUpload   = "upload"
+
+	// OtherQueue labels queues that were not registered, such as a mistyped QUEUE of a request.
+	OtherQueue = "other"
+)
+
+// queues are the queue names used as label values.
+var queues sync.Map
+
+var (
+	Published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "published_messages_total",
+		Help:      "Messages published to the broker by queue and result.",
+	}, []string{"queue", "result"})
+
+	Consumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "consumed_messages_total",
+		Help:      "Messages handled by consumers by queue and outcome.",
+	}, []string{"queue", "outcome"})
+
+	ConversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of external conversion tool runs.",
+		Buckets:   []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"tool", "format", "result"})
+
+	TransferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfer_bytes_total",
+		Help:      "Bytes of successful downloads from and uploads to portals.",
+	}, []string{"direction"})
+
+	TransferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transfer_duration_seconds",
+		Help:      "Latency of file downloads and upload chunk requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"direction", "result"})
+
+	RabbitReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rabbitmq_reconnects_total",
+		Help:      "Successful reconnections to RabbitMQ.",
+	})
+
+	RedisReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_reconnects_total",
+		Help:      "Times Redis became available again after a failure.",
+	})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve starts serving /metrics on the port apart from the API, so the API port can be published
+// without them. The returned server is stopped with Shutdown.
+func Serve(log *slog.Logger, port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%s", port),
+		Handler: mux,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed to start metrics server", sl.Err(err))
+		}
+	}()
+	return srv
+}
+
+// RegisterQueues adds the queues to the label values of QueueLabel.
+func RegisterQueues(names ...string) {
+	for _, name := range names {
+		queues.Store(name, struct{}{})
+	}
+}
+
+// QueueLabel returns the queue as a label value, unknown queues share OtherQueue,
+// so a client cannot add series with the queue of a request.
+func QueueLabel(name string) string {
+	if _, ok := queues.Load(name); ok {
+		return name
+	}
+	return OtherQueue
+}
+
+// RetryQueueLabel labels the messages put aside for a retry of the queue.
+func RetryQueueLabel(name string) string {
+	return QueueLabel(name) + "_retry"
+}
+
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func ObserveConversion(tool string, format string, start time.Time, err error) {
+	ConversionDuration.WithLabelValues(tool, format, Result(err)).Observe(time.Since(start).Seconds())
+}
+
+func ObserveTransfer(direction string, bytes int64, start time.Time, err error) {
+	TransferDuration.WithLabelValues(direction, Result(err)).Observe(time.Since(start).Seconds())
+	if err == nil && bytes > 0 {
+		TransferBytes.WithLabelValues(direction).Add(float64(bytes))
+	}
+}
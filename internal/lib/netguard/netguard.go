@@ -0,0 +1,227 @@
+package netguard
+
+import (
+	"bitrix-converter/internal/config"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxRedirects    = 10
+	dialTimeout     = 10 * time.Second
+	idleConnTimeout = 90 * time.Second
+)
+
+// ErrBlocked is matched by every error caused by a forbidden destination.
+var ErrBlocked = errors.New("destination is not allowed")
+
+type BlockedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("destination [%s] is not allowed: %s", e.Host, e.Reason)
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+var (
+	// ranges not covered by the net.IP helpers
+	reservedNets = mustParseNets(
+		"0.0.0.0/8",
+		"100.64.0.0/10",
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"240.0.0.0/4",
+		// NAT64 prefixes, a translator on the way turns them into any IPv4 address, internal ones too
+		"64:ff9b::/96",
+		"64:ff9b:1::/48",
+	)
+
+	// unguarded is shared by the clients of a nil Guard
+	unguarded = newTransport((&net.Dialer{Timeout: dialTimeout}).DialContext)
+)
+
+// Guard restricts outgoing connections to public addresses, except explicitly allowed
+// networks and hosts. It checks the address actually dialed, so DNS rebinding and
+// redirects to internal hosts are blocked as well.
+type Guard struct {
+	enabled      bool
+	allowedNets  []*net.IPNet
+	allowedHosts []string
+	// transport is shared by all clients, so they reuse idle connections
+	transport *http.Transport
+}
+
+func New(cfg config.NetGuardConfig) (*Guard, error) {
+	g := &Guard{enabled: cfg.Enabled}
+
+	for _, cidr := range cfg.AllowedNetworks {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network [%s]: [%w]", cidr, err)
+		}
+		g.allowedNets = append(g.allowedNets, ipNet)
+	}
+
+	for _, host := range cfg.AllowedHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			g.allowedHosts = append(g.allowedHosts, host)
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+	}
+	if g.enabled {
+		g.transport = newTransport(g.dialContext(dialer))
+	} else {
+		g.transport = newTransport(dialer.DialContext)
+	}
+
+	return g, nil
+}
+
+// Client returns an http.Client whose connections and redirects pass through the guard.
+// A nil Guard returns a client without restrictions.
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	if g == nil {
+		return &http.Client{
+			Timeout:   timeout,
+			Transport: unguarded,
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: g.transport,
+	}
+	if g.enabled {
+		client.CheckRedirect = g.checkRedirect
+	}
+	return client
+}
+
+// newTransport has no proxy, a proxy would connect to the destination past the guard.
+func newTransport(dial func(ctx context.Context, network string, address string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext:     dial,
+		IdleConnTimeout: idleConnTimeout,
+	}
+}
+
+func (g *Guard) dialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = g.control
+
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && g.allowedHost(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+}
+
+// control runs after name resolution with the IP address that is about to be dialed.
+func (g *Guard) control(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &BlockedError{Host: address, Reason: "malformed address"}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &BlockedError{Host: host, Reason: "not an ip address"}
+	}
+
+	if reason := g.blockReason(ip); reason != "" {
+		return &BlockedError{Host: host, Reason: reason}
+	}
+	return nil
+}
+
+func (g *Guard) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return &BlockedError{Host: req.URL.Host, Reason: "redirect to scheme " + req.URL.Scheme}
+	}
+	if ip := net.ParseIP(req.URL.Hostname()); ip != nil {
+		if reason := g.blockReason(ip); reason != "" {
+			return &BlockedError{Host: req.URL.Host, Reason: "redirect to " + reason}
+		}
+	}
+	return nil
+}
+
+func (g *Guard) blockReason(ip net.IP) string {
+	for _, ipNet := range g.allowedNets {
+		if ipNet.Contains(ip) {
+			return ""
+		}
+	}
+
+	switch {
+	case ip.IsLoopback():
+		return "loopback address"
+	case ip.IsPrivate():
+		return "private address"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local address"
+	case ip.IsUnspecified():
+		return "unspecified address"
+	case ip.IsMulticast():
+		return "multicast address"
+	}
+
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return "reserved address"
+		}
+	}
+	return ""
+}
+
+func (g *Guard) allowedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range g.allowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
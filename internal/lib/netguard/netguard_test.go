@@ -0,0 +1,172 @@
+package netguard
+
+import (
+	"bitrix-converter/internal/config"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newGuard(t *testing.T, cfg config.NetGuardConfig) *Guard {
+	t.Helper()
+
+	g, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new guard: %v", err)
+	}
+	return g
+}
+
+func TestBlockReason(t *testing.T) {
+	g := newGuard(t, config.NetGuardConfig{Enabled: true})
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.1", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"240.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b:1::a00:1", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"2606:4700:4700::1111", false},
+		{"64:ff9c::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			reason := g.blockReason(net.ParseIP(tt.ip))
+			if (reason != "") != tt.blocked {
+				t.Fatalf("reason %q, want blocked %v", reason, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	g := newGuard(t, config.NetGuardConfig{Enabled: true, AllowedNetworks: []string{"10.0.0.0/8", " 192.168.1.5 ", "fd00::1", ""}})
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"10.20.30.40", false},
+		{"192.168.1.5", false},
+		{"192.168.1.6", true},
+		{"fd00::1", false},
+		{"fd00::2", true},
+		{"127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			reason := g.blockReason(net.ParseIP(tt.ip))
+			if (reason != "") != tt.blocked {
+				t.Fatalf("reason %q, want blocked %v", reason, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestInvalidAllowedNetwork(t *testing.T) {
+	if _, err := New(config.NetGuardConfig{AllowedNetworks: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("invalid network accepted")
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	port := srv.URL[strings.LastIndex(srv.URL, ":"):]
+
+	tests := []struct {
+		name    string
+		guard   *Guard
+		url     string
+		blocked bool
+	}{
+		{"nil guard", nil, srv.URL, false},
+		{"disabled", newGuard(t, config.NetGuardConfig{}), srv.URL, false},
+		{"loopback", newGuard(t, config.NetGuardConfig{Enabled: true}), srv.URL, true},
+		{"allowed network", newGuard(t, config.NetGuardConfig{Enabled: true, AllowedNetworks: []string{"127.0.0.0/8"}}), srv.URL, false},
+		{"allowed host", newGuard(t, config.NetGuardConfig{Enabled: true, AllowedHosts: []string{"LocalHost"}}), "http://localhost" + port, false},
+		{"other host", newGuard(t, config.NetGuardConfig{Enabled: true, AllowedHosts: []string{"example.com"}}), "http://localhost" + port, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tt.guard.Client(5 * time.Second).Get(tt.url)
+			if tt.blocked {
+				if !errors.Is(err, ErrBlocked) {
+					t.Fatalf("got %v, want a blocked destination", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			_ = res.Body.Close()
+		})
+	}
+}
+
+func TestRedirectToPrivateAddress(t *testing.T) {
+	tests := []struct {
+		location string
+		blocked  bool
+	}{
+		{"http://192.168.1.1/internal", true},
+		{"http://[::1]/internal", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://[64:ff9b::a9fe:a9fe]/latest/meta-data/", true},
+		{"file:///etc/passwd", true},
+		{"/final", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/final" {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				http.Redirect(w, r, tt.location, http.StatusFound)
+			}))
+			defer srv.Close()
+
+			g := newGuard(t, config.NetGuardConfig{Enabled: true, AllowedNetworks: []string{"127.0.0.1"}})
+			res, err := g.Client(5 * time.Second).Get(srv.URL)
+			if tt.blocked {
+				if !errors.Is(err, ErrBlocked) {
+					t.Fatalf("got %v, want a blocked redirect", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			_ = res.Body.Close()
+			if res.StatusCode != http.StatusNoContent {
+				t.Fatalf("status %d after the redirect, want %d", res.StatusCode, http.StatusNoContent)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package procgroup
+
+import (
+	"os/exec"
+)
+
+// Set keeps the default behaviour of killing only the started process.
+func Set(cmd *exec.Cmd) {}
+
+func Kill(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/queue"
+	"bitrix-converter/internal/lib/queue/memory"
+	"bitrix-converter/internal/lib/queue/redis"
+	"bitrix-converter/internal/lib/rabbitmq"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+const (
+	RabbitMQ = "rabbitmq"
+	Redis    = "redis"
+	Memory   = "memory"
+)
+
+// New connects to the queue backend selected by CONVERT_QUEUE_BACKEND.
+// The memory backend is shared only inside one process, so it is meant for the all-in-one mode.
+func New(log *slog.Logger, cfg *config.Config) (queue.Queue, error) {
+	metrics.RegisterQueues(TaskQueues(cfg)...)
+	metrics.RegisterQueues(jobs.StatusQueue)
+
+	switch cfg.Queue.Backend {
+	case RabbitMQ:
+		rabbit := rabbitmq.New(log, cfg.Rabbit, cfg.Queue.MaxPriority)
+		if err := rabbit.Connect(); err != nil {
+			return nil, err
+		}
+		go rabbit.Reconnect()
+		return rabbit, nil
+	case Redis:
+		r, err := redis.New(log, cfg.Redis, cfg.Queue.MaxPriority)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.Connect(); err != nil {
+			return nil, err
+		}
+		go r.Watch()
+		return r, nil
+	case Memory:
+		return memory.New(log, cfg.Queue.MaxPriority), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend [%s]", cfg.Queue.Backend)
+	}
+}
+
+// TaskQueues lists the queues served by consumers and the default queue.
+func TaskQueues(cfg *config.Config) []string {
+	queues := slices.Sorted(maps.Keys(cfg.Consumer.Workers))
+	if !slices.Contains(queues, cfg.Rabbit.DefaultQueue) {
+		queues = append(queues, cfg.Rabbit.DefaultQueue)
+	}
+	return queues
+}
+
+// DeclareTaskQueues declares the queues served by consumers and the default queue.
+func DeclareTaskQueues(q queue.Queue, cfg *config.Config) error {
+	for _, name := range TaskQueues(cfg) {
+		if err := q.Declare(name); err != nil {
+			return fmt.Errorf("failed to declare queue [%s]: [%w]", name, err)
+		}
+	}
+	return nil
+}
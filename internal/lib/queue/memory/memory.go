@@ -0,0 +1,296 @@
+package memory
+
+import (
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/queue"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	deadSuffix = "_dead"
+	// deadLimit caps a dead-letter queue, nothing consumes it in process memory
+	deadLimit = 1000
+)
+
+var _ queue.Queue = (*Queue)(nil)
+
+// Queue keeps messages in process memory for the all-in-one mode.
+// Messages are lost when the process stops.
+type Queue struct {
+	log         *slog.Logger
+	mu          sync.Mutex
+	queues      map[string]*entries
+	maxPriority uint8
+	closed      chan struct{}
+	once        sync.Once
+}
+
+type entries struct {
+	// ready is ordered by priority, then by arrival
+	ready      []queue.Message
+	deadLetter bool
+	// wake is closed and replaced every time a message is added
+	wake chan struct{}
+}
+
+// acker settles a message delivered to a subscription and frees its prefetch slot.
+type acker struct {
+	q    *Queue
+	slot chan struct{}
+	once sync.Once
+}
+
+func New(log *slog.Logger, maxPriority uint8) *Queue {
+	return &Queue{
+		log:         log,
+		queues:      make(map[string]*entries),
+		maxPriority: maxPriority,
+		closed:      make(chan struct{}),
+	}
+}
+
+func (q *Queue) Publish(ctx context.Context, name string, message []byte) error {
+	return q.PublishPriority(ctx, name, message, 0)
+}
+
+func (q *Queue) PublishPriority(ctx context.Context, name string, message []byte, priority uint8) (err error) {
+	defer func() {
+		metrics.Published.WithLabelValues(metrics.QueueLabel(name), metrics.Result(err)).Inc()
+	}()
+
+	return q.push(queue.Message{
+		Queue:    name,
+		Body:     message,
+		Headers:  queue.InjectContext(ctx, nil),
+		Priority: min(priority, q.maxPriority),
+	})
+}
+
+func (q *Queue) Declare(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.declare(name).deadLetter = true
+	q.declare(name + deadSuffix)
+	return nil
+}
+
+// Consume delivers messages of the queue one by one while there is a free prefetch slot.
+func (q *Queue) Consume(name string, opts queue.ConsumeOptions) (<-chan queue.Message, func(), error) {
+	if opts.DeadLetter {
+		_ = q.Declare(name)
+	} else {
+		q.mu.Lock()
+		q.declare(name)
+		q.mu.Unlock()
+	}
+
+	var slots chan struct{}
+	if opts.Prefetch > 0 {
+		slots = make(chan struct{}, opts.Prefetch)
+	}
+
+	msgs := make(chan queue.Message)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(msgs)
+		for {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-done:
+					return
+				case <-q.closed:
+					return
+				}
+			}
+
+			m, wake := q.pop(name)
+			for wake != nil {
+				select {
+				case <-wake:
+				case <-done:
+					return
+				case <-q.closed:
+					return
+				}
+				m, wake = q.pop(name)
+			}
+
+			m.Acknowledger = &acker{q: q, slot: slots}
+			select {
+			case msgs <- m:
+			case <-done:
+				_ = q.requeue(m)
+				return
+			case <-q.closed:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+	return msgs, cancel, nil
+}
+
+func (q *Queue) Retry(ctx context.Context, m queue.Message, delay time.Duration) error {
+	select {
+	case <-q.closed:
+		return queue.ErrClosed
+	default:
+	}
+
+	m.Retries++
+	m.Acknowledger = nil
+	time.AfterFunc(delay, func() {
+		_ = q.push(m)
+	})
+	return nil
+}
+
+func (q *Queue) QueueLength(name string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.queues[name]
+	if !ok {
+		return 0, fmt.Errorf("queue [%s] is not declared", name)
+	}
+	return len(e.ready), nil
+}
+
+// NotifyReconnect never fires, there is no connection to lose.
+func (q *Queue) NotifyReconnect(chan struct{}) func() {
+	return func() {}
+}
+
+func (q *Queue) Close() error {
+	q.once.Do(func() {
+		close(q.closed)
+	})
+	return nil
+}
+
+func (q *Queue) declare(name string) *entries {
+	e, ok := q.queues[name]
+	if !ok {
+		e = &entries{wake: make(chan struct{})}
+		q.queues[name] = e
+	}
+	return e
+}
+
+func (q *Queue) push(m queue.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.queues[m.Queue]
+	if !ok {
+		return fmt.Errorf("%w: queue [%s]", queue.ErrUnroutable, m.Queue)
+	}
+	// after the messages of the same or a higher priority
+	i := slices.IndexFunc(e.ready, func(r queue.Message) bool {
+		return r.Priority < m.Priority
+	})
+	e.insert(i, m)
+	return nil
+}
+
+func (q *Queue) requeue(m queue.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.declare(m.Queue)
+	// before the other messages of its priority
+	i := slices.IndexFunc(e.ready, func(r queue.Message) bool {
+		return r.Priority <= m.Priority
+	})
+	e.insert(i, m)
+	return nil
+}
+
+// insert puts m at i, -1 means the end, and wakes the subscriptions.
+func (e *entries) insert(i int, m queue.Message) {
+	if i < 0 {
+		i = len(e.ready)
+	}
+	e.ready = slices.Insert(e.ready, i, m)
+	close(e.wake)
+	e.wake = make(chan struct{})
+}
+
+// pop takes the first ready message. When the queue is empty it returns the channel
+// that is closed by the next push.
+func (q *Queue) pop(name string) (queue.Message, chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.declare(name)
+	if len(e.ready) == 0 {
+		return queue.Message{}, e.wake
+	}
+	m := e.ready[0]
+	e.ready = e.ready[1:]
+	return m, nil
+}
+
+func (a *acker) release() {
+	a.once.Do(func() {
+		if a.slot != nil {
+			<-a.slot
+		}
+	})
+}
+
+func (a *acker) Ack(queue.Message) error {
+	a.release()
+	return nil
+}
+
+// Reject moves a message of a task queue to its dead-letter queue, other messages are dropped.
+// A full dead-letter queue drops its oldest message.
+func (a *acker) Reject(m queue.Message) error {
+	a.release()
+
+	a.q.mu.Lock()
+	e, ok := a.q.queues[m.Queue]
+	deadLetter := ok && e.deadLetter
+	a.q.mu.Unlock()
+
+	if !deadLetter {
+		return nil
+	}
+	m.Acknowledger = nil
+	m.Queue += deadSuffix
+	return a.q.pushDead(m)
+}
+
+func (q *Queue) pushDead(m queue.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.declare(m.Queue)
+	if len(e.ready) >= deadLimit {
+		e.ready = e.ready[1:]
+		q.log.Warn("dead-letter queue is full, the oldest message is dropped", slog.String("queue", m.Queue))
+	}
+	e.insert(-1, m)
+	return nil
+}
+
+func (a *acker) Requeue(m queue.Message) error {
+	a.release()
+	m.Acknowledger = nil
+	return a.q.requeue(m)
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"time"
+)
+
+var (
+	ErrUnroutable = errors.New("message is unroutable")
+	ErrClosed     = errors.New("queue is closed")
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, queue string, message []byte) error
+	// PublishPriority publishes a message that is delivered before the ones with a lower priority.
+	// Priorities above the configured maximum are treated as the maximum.
+	PublishPriority(ctx context.Context, queue string, message []byte, priority uint8) error
+}
+
+// Queue is a message broker backend. Task queues are declared with a dead-letter queue
+// "<queue>_dead" that receives rejected messages.
+type Queue interface {
+	Publisher
+
+	// Declare creates the task queue and its dead-letter queue.
+	Declare(queue string) error
+
+	// Consume declares the queue and delivers its messages until cancel is called
+	// or the subscription breaks, then the channel is closed. Messages that were not settled
+	// by cancel are delivered again.
+	Consume(queue string, opts ConsumeOptions) (msgs <-chan Message, cancel func(), err error)
+
+	// Retry publishes a copy of the message with Retries incremented, it is delivered again after delay.
+	// The original message still has to be settled.
+	Retry(ctx context.Context, msg Message, delay time.Duration) error
+
+	// QueueLength returns the number of messages waiting for delivery.
+	QueueLength(queue string) (int, error)
+
+	// NotifyReconnect registers c to receive a value after the backend restored its connection.
+	NotifyReconnect(c chan struct{}) (cancel func())
+
+	Close() error
+}
+
+type ConsumeOptions struct {
+	// Prefetch limits the number of unsettled messages, 0 means no limit.
+	Prefetch int
+	// DeadLetter declares the queue as a task queue, otherwise rejected messages are dropped.
+	DeadLetter bool
+}
+
+// Acknowledger settles a message in the backend it came from.
+type Acknowledger interface {
+	Ack(m Message) error
+	Reject(m Message) error
+	Requeue(m Message) error
+}
+
+type Message struct {
+	Queue    string
+	Body     []byte
+	Headers  map[string]string
+	Priority uint8
+	// Retries is the number of times the message went through Retry.
+	Retries int
+
+	Acknowledger Acknowledger
+}
+
+// Ack removes the processed message from the queue.
+func (m Message) Ack() error {
+	return m.Acknowledger.Ack(m)
+}
+
+// Reject moves the message to the dead-letter queue.
+func (m Message) Reject() error {
+	return m.Acknowledger.Reject(m)
+}
+
+// Requeue returns the message to the queue for another delivery.
+func (m Message) Requeue() error {
+	return m.Acknowledger.Requeue(m)
+}
+
+// InjectContext writes the trace context of ctx into message headers.
+func InjectContext(ctx context.Context, headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	return headers
+}
+
+// ExtractContext returns ctx with the trace context found in message headers.
+func ExtractContext(ctx context.Context, headers map[string]string) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
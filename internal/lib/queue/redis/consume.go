@@ -0,0 +1,459 @@
+package redis
+
+import (
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/queue"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	goredis "github.com/redis/go-redis/v9"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// pollInterval bounds a blocking read, due retries are moved at least that often.
+	pollInterval = 2 * time.Second
+	moveBatch    = 100
+)
+
+// subscription reads the streams of a queue under its own consumer name.
+type subscription struct {
+	r          *Redis
+	queue      string
+	consumer   string
+	deadLetter bool
+	slots      chan struct{}
+	lastClaim  time.Time
+	// streams of the queue from the highest priority to the lowest
+	streams []string
+}
+
+// acker settles an entry. Until then it keeps claiming the entry for its consumer,
+// so a long conversion is not taken over by another consumer.
+type acker struct {
+	s      *subscription
+	stream string
+	id     string
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// Consume creates the consumer groups and delivers entries of the queue: first the ones
+// that stayed pending for ClaimIdle on other consumers, then new ones, higher priorities first.
+// cancel stops the subscription, a message that was read but not handed over is put back to the stream.
+func (r *Redis) Consume(name string, opts queue.ConsumeOptions) (<-chan queue.Message, func(), error) {
+	var err error
+	if opts.DeadLetter {
+		err = r.Declare(name)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		err = r.createGroup(ctx, r.key(name))
+		cancel()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &subscription{
+		r:          r,
+		queue:      name,
+		consumer:   consumerName(),
+		deadLetter: opts.DeadLetter,
+		streams:    []string{r.key(name)},
+	}
+	if opts.DeadLetter {
+		// only task queues are declared with priorities
+		s.streams = r.streams(name)
+	}
+	if opts.Prefetch > 0 {
+		s.slots = make(chan struct{}, opts.Prefetch)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	msgs := make(chan queue.Message)
+
+	go func() {
+		defer close(msgs)
+		defer s.leave()
+
+		if err := s.run(ctx, msgs); err != nil && ctx.Err() == nil {
+			r.log.Error("redis subscription failed", slog.String("queue", name), sl.Err(err))
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(stop)
+	}
+	return msgs, cancel, nil
+}
+
+func (s *subscription) run(ctx context.Context, msgs chan<- queue.Message) error {
+	for {
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			case <-s.r.done:
+				return queue.ErrClosed
+			}
+		}
+
+		stream, entry, err := s.next(ctx)
+		if err != nil {
+			s.release()
+			return err
+		}
+
+		m, err := s.message(stream, entry)
+		if err != nil {
+			s.release()
+			s.r.log.Error("drop malformed redis entry", slog.String("queue", s.queue), slog.String("id", entry.ID), sl.Err(err))
+			_ = s.settle(stream, entry.ID, nil)
+			continue
+		}
+
+		select {
+		case msgs <- m:
+		case <-ctx.Done():
+			_ = m.Requeue()
+			return nil
+		}
+	}
+}
+
+// next returns the next entry for this consumer and its stream: an abandoned one or a new one.
+func (s *subscription) next(ctx context.Context) (string, goredis.XMessage, error) {
+	for {
+		if time.Since(s.lastClaim) >= s.r.cfg.ClaimIdle/2 {
+			stream, entry, err := s.claim(ctx)
+			if err != nil {
+				return "", goredis.XMessage{}, err
+			}
+			if stream != "" {
+				s.r.log.Warn("claimed abandoned redis entry", slog.String("queue", s.queue), slog.String("id", entry.ID))
+				return stream, entry, nil
+			}
+			// look again only after a while, until then every pending entry has an owner
+			s.lastClaim = time.Now()
+		}
+
+		if s.deadLetter {
+			keys := append([]string{s.r.key(s.queue + retrySuffix)}, s.streams...)
+			err := moveDue.Run(ctx, s.r.client, keys, time.Now().UnixMilli(), moveBatch).Err()
+			if err != nil && !errors.Is(err, goredis.Nil) {
+				return "", goredis.XMessage{}, fmt.Errorf("failed to move due retries: [%w]", err)
+			}
+		}
+
+		// a group read of several streams takes an entry of each one that has it, so every stream
+		// is read on its own in the order of priority and the wait below only watches them
+		for _, stream := range s.streams {
+			entry, ok, err := s.read(ctx, stream)
+			if err != nil {
+				return "", goredis.XMessage{}, err
+			}
+			if ok {
+				return stream, entry, nil
+			}
+		}
+
+		if err := s.wait(ctx); err != nil {
+			return "", goredis.XMessage{}, err
+		}
+	}
+}
+
+// read takes one new entry of the stream for this consumer without waiting.
+func (s *subscription) read(ctx context.Context, stream string) (goredis.XMessage, bool, error) {
+	res, err := s.r.client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group:    s.r.cfg.Group,
+		Consumer: s.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	if errors.Is(err, goredis.Nil) {
+		return goredis.XMessage{}, false, nil
+	}
+	if err != nil {
+		return goredis.XMessage{}, false, fmt.Errorf("failed to read stream: [%w]", err)
+	}
+	if len(res) == 0 || len(res[0].Messages) == 0 {
+		return goredis.XMessage{}, false, nil
+	}
+	return res[0].Messages[0], true, nil
+}
+
+// wait blocks until an entry is added to any stream of the queue or for pollInterval. It does not take
+// the entry, so an entry added right before the wait is read by the next pass, after pollInterval at the latest.
+func (s *subscription) wait(ctx context.Context) error {
+	args := append([]string{}, s.streams...)
+	for range s.streams {
+		args = append(args, "$")
+	}
+
+	err := s.r.client.XRead(ctx, &goredis.XReadArgs{
+		Streams: args,
+		Count:   1,
+		Block:   pollInterval,
+	}).Err()
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return fmt.Errorf("failed to wait for stream: [%w]", err)
+	}
+	return nil
+}
+
+// claim takes over one entry that was pending on another consumer for ClaimIdle.
+// An entry delivered more than MaxDeliveries times is buried instead, the next one is claimed.
+// It returns an empty stream when there is none.
+func (s *subscription) claim(ctx context.Context) (string, goredis.XMessage, error) {
+	for _, stream := range s.streams {
+		for {
+			claimed, _, err := s.r.client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+				Stream:   stream,
+				Group:    s.r.cfg.Group,
+				Consumer: s.consumer,
+				MinIdle:  s.r.cfg.ClaimIdle,
+				Start:    "0-0",
+				Count:    1,
+			}).Result()
+			if err != nil {
+				return "", goredis.XMessage{}, fmt.Errorf("failed to claim pending entries: [%w]", err)
+			}
+			if len(claimed) == 0 {
+				break
+			}
+			entry := claimed[0]
+
+			deliveries, err := s.deliveries(ctx, stream, entry.ID)
+			if err != nil {
+				return "", goredis.XMessage{}, err
+			}
+			if s.r.cfg.MaxDeliveries <= 0 || deliveries <= s.r.cfg.MaxDeliveries {
+				return stream, entry, nil
+			}
+
+			s.r.log.Error("bury redis entry delivered too many times",
+				slog.String("queue", s.queue),
+				slog.String("id", entry.ID),
+				slog.Int64("deliveries", deliveries))
+			if err = s.bury(stream, entry); err != nil {
+				return "", goredis.XMessage{}, err
+			}
+		}
+	}
+	return "", goredis.XMessage{}, nil
+}
+
+// deliveries returns the number of times the pending entry was delivered, the claim included.
+func (s *subscription) deliveries(ctx context.Context, stream string, id string) (int64, error) {
+	pending, err := s.r.client.XPendingExt(ctx, &goredis.XPendingExtArgs{
+		Stream: stream,
+		Group:  s.r.cfg.Group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect pending entry [%s]: [%w]", id, err)
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	return pending[0].RetryCount, nil
+}
+
+// bury moves an entry of a task queue to its dead-letter stream as it is, other entries are dropped.
+func (s *subscription) bury(stream string, entry goredis.XMessage) error {
+	if !s.deadLetter {
+		return s.settle(stream, entry.ID, nil)
+	}
+	return s.settle(stream, entry.ID, func(ctx context.Context, pipe goredis.Pipeliner) {
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream: s.r.key(s.queue + deadSuffix),
+			MaxLen: deadMaxLen,
+			Approx: true,
+			Values: entry.Values,
+		})
+	})
+}
+
+func (s *subscription) message(stream string, entry goredis.XMessage) (queue.Message, error) {
+	raw, ok := entry.Values[messageField].(string)
+	if !ok {
+		return queue.Message{}, errors.New("no message field")
+	}
+
+	var e envelope
+	if err := json.Unmarshal([]byte(raw), &e); err != nil {
+		return queue.Message{}, fmt.Errorf("failed to decode message: [%w]", err)
+	}
+
+	a := &acker{s: s, stream: stream, id: entry.ID, stop: make(chan struct{})}
+	go a.keepAlive()
+
+	return queue.Message{
+		Queue:        s.queue,
+		Body:         e.Body,
+		Headers:      e.Headers,
+		Priority:     e.Priority,
+		Retries:      e.Retries,
+		Acknowledger: a,
+	}, nil
+}
+
+// settle acknowledges and deletes the entry, add puts its replacement in the same transaction.
+func (s *subscription) settle(stream string, id string, add func(ctx context.Context, pipe goredis.Pipeliner)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	_, err := s.r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		if add != nil {
+			add(ctx, pipe)
+		}
+		pipe.XAck(ctx, stream, s.r.cfg.Group, id)
+		pipe.XDel(ctx, stream, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle entry [%s] of queue [%s]: [%w]", id, s.queue, err)
+	}
+	return nil
+}
+
+func (s *subscription) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// leave removes the consumer from the groups unless it still owns pending entries,
+// they are claimed by other consumers later.
+func (s *subscription) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	for _, stream := range s.streams {
+		pending, err := s.r.client.XPendingExt(ctx, &goredis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    s.r.cfg.Group,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: s.consumer,
+		}).Result()
+		if err != nil || len(pending) > 0 {
+			continue
+		}
+		_ = s.r.client.XGroupDelConsumer(ctx, stream, s.r.cfg.Group, s.consumer).Err()
+	}
+}
+
+// keepAlive resets the idle time of the entry until it is settled. It stops once the entry
+// is no longer pending on this consumer, a renewal must not take it back from the one that claimed it.
+func (a *acker) keepAlive() {
+	ticker := time.NewTicker(a.s.r.cfg.ClaimIdle / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-a.s.r.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		owned, err := renew.Run(ctx, a.s.r.client, []string{a.stream}, a.s.r.cfg.Group, a.id, a.s.consumer).Int()
+		cancel()
+		if err != nil {
+			a.s.r.log.Warn("failed to keep redis entry claimed", slog.String("id", a.id), sl.Err(err))
+			continue
+		}
+		if owned == 0 {
+			a.s.r.log.Warn("redis entry is no longer pending on this consumer", slog.String("queue", a.s.queue), slog.String("id", a.id))
+			return
+		}
+	}
+}
+
+func (a *acker) done() {
+	a.once.Do(func() {
+		close(a.stop)
+		a.s.release()
+	})
+}
+
+func (a *acker) Ack(queue.Message) error {
+	a.done()
+	return a.s.settle(a.stream, a.id, nil)
+}
+
+// Reject moves an entry of a task queue to its dead-letter stream, other entries are dropped.
+func (a *acker) Reject(m queue.Message) error {
+	a.done()
+	if !a.s.deadLetter {
+		return a.s.settle(a.stream, a.id, nil)
+	}
+
+	data, err := json.Marshal(envelope{
+		Id:       a.id,
+		Body:     m.Body,
+		Headers:  m.Headers,
+		Priority: m.Priority,
+		Retries:  m.Retries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: [%w]", err)
+	}
+
+	return a.s.settle(a.stream, a.id, func(ctx context.Context, pipe goredis.Pipeliner) {
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream: a.s.r.key(a.s.queue + deadSuffix),
+			MaxLen: deadMaxLen,
+			Approx: true,
+			Values: []any{messageField, data},
+		})
+	})
+}
+
+// Requeue adds the message to the end of its stream and deletes the delivered entry.
+func (a *acker) Requeue(m queue.Message) error {
+	a.done()
+
+	data, err := json.Marshal(envelope{
+		Body:     m.Body,
+		Headers:  m.Headers,
+		Priority: m.Priority,
+		Retries:  m.Retries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: [%w]", err)
+	}
+
+	return a.s.settle(a.stream, a.id, func(ctx context.Context, pipe goredis.Pipeliner) {
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream: a.stream,
+			Values: []any{messageField, data},
+		})
+	})
+}
+
+// consumerName is unique per subscription: a restarted process must not inherit
+// the pending entries of its previous run, they are claimed after ClaimIdle instead.
+func consumerName() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return host + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,341 @@
+package redis
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/queue"
+	"bitrix-converter/internal/lib/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	goredis "github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// messageField is the only field of a stream entry, it holds the encoded envelope.
+	messageField = "message"
+	deadSuffix   = "_dead"
+	retrySuffix  = "_retry"
+	// deadMaxLen caps a dead-letter stream, the oldest entries are trimmed.
+	deadMaxLen   = 100000
+	pingInterval = 5 * time.Second
+	opTimeout    = 5 * time.Second
+	// statusMaxLen caps the job status stream while the producer does not read it.
+	statusMaxLen = 100000
+)
+
+var _ queue.Queue = (*Redis)(nil)
+
+// Redis keeps every queue in a stream read by one consumer group, a task queue has one more stream
+// "<queue>_p<N>" for every priority N up to maxPriority. A message stays pending until it is settled:
+// Ack deletes the entry, Reject moves it to the "<queue>_dead" stream.
+// Entries left pending by a crashed consumer are claimed by another one after ClaimIdle,
+// up to MaxDeliveries deliveries in total.
+type Redis struct {
+	mu          sync.RWMutex
+	client      *goredis.Client
+	log         *slog.Logger
+	cfg         config.RedisConfig
+	maxPriority uint8
+	done        chan struct{}
+	once        sync.Once
+	subscribers map[chan struct{}]struct{}
+}
+
+// envelope is a message as it is stored in a stream or in the retry set.
+type envelope struct {
+	Id       string            `json:"id,omitempty"`
+	Body     []byte            `json:"body"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Priority uint8             `json:"priority,omitempty"`
+	Retries  int               `json:"retries,omitempty"`
+}
+
+// moveDue moves the retries that are due from the retry set (KEYS[1]) to the streams of their priority
+// listed from the highest one (KEYS[2]) to priority 0 (KEYS[#KEYS]).
+var moveDue = goredis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	local priority = cjson.decode(m).priority or 0
+	redis.call('XADD', KEYS[math.max(#KEYS - priority, 2)], '*', 'message', m)
+	redis.call('ZREM', KEYS[1], m)
+end
+return #due
+`)
+
+// renew resets the idle time of the entry ARGV[2] of the stream KEYS[1] in the group ARGV[1] only while
+// it is pending on the consumer ARGV[3]. It returns 0 when the entry was settled or claimed by another consumer.
+var renew = goredis.NewScript(`
+local pending = redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1, ARGV[3])
+if #pending == 0 then
+	return 0
+end
+redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[3], 0, ARGV[2], 'JUSTID')
+return 1
+`)
+
+func New(log *slog.Logger, cfg config.RedisConfig, maxPriority uint8) (*Redis, error) {
+	opts, err := goredis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: [%w]", err)
+	}
+	if cfg.ClaimIdle <= 0 {
+		return nil, errors.New("REDIS_CLAIM_IDLE must be positive")
+	}
+
+	return &Redis{
+		client:      goredis.NewClient(opts),
+		log:         log,
+		cfg:         cfg,
+		maxPriority: maxPriority,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan struct{}]struct{}),
+	}, nil
+}
+
+// Connect checks that Redis answers, the client dials and redials by itself.
+func (r *Redis) Connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to connect to Redis: [%w]", err)
+	}
+	r.log.Info("connected to redis", slog.String("addr", r.client.Options().Addr))
+	return nil
+}
+
+// Watch pings Redis and notifies subscribers when it answers again after a failure.
+// It returns after Close.
+func (r *Redis) Watch() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		err := r.client.Ping(ctx).Err()
+		cancel()
+
+		switch {
+		case err != nil && healthy:
+			healthy = false
+			r.log.Error("redis is unavailable", sl.Err(err))
+		case err == nil && !healthy:
+			healthy = true
+			metrics.RedisReconnects.Inc()
+			r.log.Info("redis is available again")
+			r.notifyReconnect()
+		}
+	}
+}
+
+// NotifyReconnect registers c to receive a value when Redis is available again after a failure.
+// The send does not block, so a buffered channel of one is enough. cancel removes the subscription.
+func (r *Redis) NotifyReconnect(c chan struct{}) (cancel func()) {
+	r.mu.Lock()
+	r.subscribers[c] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.subscribers, c)
+		r.mu.Unlock()
+	}
+}
+
+func (r *Redis) notifyReconnect() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for c := range r.subscribers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops Watch and closes the client.
+func (r *Redis) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.done)
+		err = r.client.Close()
+	})
+	return err
+}
+
+// Declare creates the streams of the task queue with the consumer group and its dead-letter stream.
+func (r *Redis) Declare(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	if err := r.createGroup(ctx, r.key(name+deadSuffix)); err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: [%w]", err)
+	}
+	for _, stream := range r.streams(name) {
+		if err := r.createGroup(ctx, stream); err != nil {
+			return fmt.Errorf("failed to declare queue: [%w]", err)
+		}
+	}
+	return nil
+}
+
+// createGroup creates the stream and the consumer group, the group reads entries added before it.
+func (r *Redis) createGroup(ctx context.Context, stream string) error {
+	err := r.client.XGroupCreateMkStream(ctx, stream, r.cfg.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group for [%s]: [%w]", stream, err)
+	}
+	return nil
+}
+
+// Publish adds the message to the stream of the queue. A queue that was never declared
+// has no stream and fails with ErrUnroutable. The job status stream is created by the first event,
+// consumers report statuses before the producer starts reading them.
+func (r *Redis) Publish(ctx context.Context, name string, message []byte) error {
+	return r.PublishPriority(ctx, name, message, 0)
+}
+
+// PublishPriority adds the message to the stream of its priority.
+func (r *Redis) PublishPriority(ctx context.Context, name string, message []byte, priority uint8) (err error) {
+	defer func() {
+		metrics.Published.WithLabelValues(metrics.QueueLabel(name), metrics.Result(err)).Inc()
+	}()
+
+	ctx, span := tracing.Start(ctx, "redis.Publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", name),
+			attribute.Int("messaging.message.priority", int(priority)),
+		),
+	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return r.add(ctx, name, envelope{
+		Body:     message,
+		Headers:  queue.InjectContext(ctx, nil),
+		Priority: min(priority, r.maxPriority),
+	})
+}
+
+func (r *Redis) add(ctx context.Context, name string, e envelope) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: [%w]", err)
+	}
+
+	args := &goredis.XAddArgs{
+		Stream:     r.stream(name, e.Priority),
+		NoMkStream: true,
+		Values:     []any{messageField, data},
+	}
+	if name == jobs.StatusQueue {
+		args.NoMkStream = false
+		args.MaxLen = statusMaxLen
+		args.Approx = true
+	}
+
+	err = r.client.XAdd(ctx, args).Err()
+	if errors.Is(err, goredis.Nil) {
+		return fmt.Errorf("%w: queue [%s]", queue.ErrUnroutable, name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish message: [%w]", err)
+	}
+	return nil
+}
+
+// Retry puts a copy of the message into the retry set of its queue, scored by the time it is due.
+// Consumers of the queue move due retries back to the stream.
+func (r *Redis) Retry(ctx context.Context, m queue.Message, delay time.Duration) (err error) {
+	defer func() {
+		metrics.Published.WithLabelValues(metrics.RetryQueueLabel(m.Queue), metrics.Result(err)).Inc()
+	}()
+
+	e := envelope{
+		Body:     m.Body,
+		Headers:  m.Headers,
+		Priority: min(m.Priority, r.maxPriority),
+		Retries:  m.Retries + 1,
+	}
+	if a, ok := m.Acknowledger.(*acker); ok {
+		e.Id = a.id
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: [%w]", err)
+	}
+
+	err = r.client.ZAdd(ctx, r.key(m.Queue+retrySuffix), goredis.Z{
+		Score:  float64(time.Now().Add(delay).UnixMilli()),
+		Member: data,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to schedule retry of queue [%s]: [%w]", m.Queue, err)
+	}
+	return nil
+}
+
+// QueueLength returns the number of entries of all priorities that were not delivered yet.
+func (r *Redis) QueueLength(name string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	var n int64
+	for _, stream := range r.streams(name) {
+		length, err := r.client.XLen(ctx, stream).Result()
+		if err != nil {
+			return 0, fmt.Errorf("failed to inspect queue [%s]: [%w]", name, err)
+		}
+		if length == 0 {
+			continue
+		}
+		pending, err := r.client.XPending(ctx, stream, r.cfg.Group).Result()
+		if err != nil {
+			return 0, fmt.Errorf("failed to inspect queue [%s]: [%w]", name, err)
+		}
+		n += max(length-pending.Count, 0)
+	}
+	return int(n), nil
+}
+
+func (r *Redis) key(name string) string {
+	return r.cfg.KeyPrefix + name
+}
+
+// stream is the stream of the queue for the priority, priority 0 uses the stream of the queue itself.
+func (r *Redis) stream(name string, priority uint8) string {
+	if priority == 0 {
+		return r.key(name)
+	}
+	return r.key(fmt.Sprintf("%s_p%d", name, priority))
+}
+
+// streams lists the streams of the task queue from the highest priority to the lowest.
+func (r *Redis) streams(name string) []string {
+	streams := make([]string, 0, int(r.maxPriority)+1)
+	for p := int(r.maxPriority); p >= 0; p-- {
+		streams = append(streams, r.stream(name, uint8(p)))
+	}
+	return streams
+}
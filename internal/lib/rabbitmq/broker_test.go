@@ -0,0 +1,234 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// AMQP 0-9-1 class and method ids the fake broker understands.
+const (
+	classConnection = 10
+	classChannel    = 20
+	classQueue      = 50
+
+	methodStart     = 10
+	methodStartOk   = 11
+	methodTune      = 30
+	methodTuneOk    = 31
+	methodOpen      = 40
+	methodOpenOk    = 41
+	methodClose     = 50
+	methodCloseOk   = 51
+	methodChOpen    = 10
+	methodChOpenOk  = 11
+	methodChClose   = 40
+	methodChCloseOk = 41
+	methodDeclare   = 10
+	methodDeclareOk = 11
+
+	replyPreconditionFailed = 406
+
+	frameMethod = 1
+	frameEnd    = 0xCE
+)
+
+// fakeBroker is a stand-in for RabbitMQ that speaks just enough AMQP for the client to connect,
+// open channels and declare queues. Every accepted connection gets a number starting at 1,
+// the queues declared on it are recorded under that number. Declaring a queue listed in
+// inequivalent fails like a queue that exists with other arguments.
+type fakeBroker struct {
+	ln           net.Listener
+	mu           sync.Mutex
+	conns        []net.Conn
+	declared     map[int][]string
+	inequivalent map[string]bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	b := &fakeBroker{ln: ln, declared: make(map[int][]string), inequivalent: make(map[string]bool)}
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "amqp://guest:guest@" + b.ln.Addr().String() + "/"
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, conn)
+		n := len(b.conns)
+		b.mu.Unlock()
+
+		go b.handle(conn, n)
+	}
+}
+
+// drop cuts the open connections like a broker restart does.
+func (b *fakeBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		_ = conn.Close()
+	}
+}
+
+func (b *fakeBroker) close() {
+	_ = b.ln.Close()
+	b.drop()
+}
+
+func (b *fakeBroker) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// queues returns the queues declared on the n-th connection.
+func (b *fakeBroker) queues(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.declared[n]...)
+}
+
+func (b *fakeBroker) handle(conn net.Conn, n int) {
+	defer conn.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	var start bytes.Buffer
+	start.Write([]byte{0, 9})
+	writeTable(&start)
+	writeLongStr(&start, "PLAIN")
+	writeLongStr(&start, "en_US")
+	if writeMethod(conn, 0, classConnection, methodStart, start.Bytes()) != nil {
+		return
+	}
+
+	for {
+		channel, class, method, args, err := readMethod(conn)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case class == classConnection && method == methodStartOk:
+			var tune bytes.Buffer
+			_ = binary.Write(&tune, binary.BigEndian, uint16(0))
+			_ = binary.Write(&tune, binary.BigEndian, uint32(131072))
+			_ = binary.Write(&tune, binary.BigEndian, uint16(0))
+			err = writeMethod(conn, 0, classConnection, methodTune, tune.Bytes())
+		case class == classConnection && method == methodTuneOk:
+		case class == classConnection && method == methodOpen:
+			err = writeMethod(conn, 0, classConnection, methodOpenOk, []byte{0})
+		case class == classConnection && method == methodClose:
+			_ = writeMethod(conn, 0, classConnection, methodCloseOk, nil)
+			return
+		case class == classChannel && method == methodChOpen:
+			err = writeMethod(conn, channel, classChannel, methodChOpenOk, []byte{0, 0, 0, 0})
+		case class == classChannel && method == methodChClose:
+			err = writeMethod(conn, channel, classChannel, methodChCloseOk, nil)
+		case class == classChannel && method == methodChCloseOk:
+		case class == classQueue && method == methodDeclare:
+			// reserved short, then the queue name
+			name := string(args[3 : 3+int(args[2])])
+			b.mu.Lock()
+			b.declared[n] = append(b.declared[n], name)
+			inequivalent := b.inequivalent[name]
+			b.mu.Unlock()
+
+			if inequivalent {
+				var closing bytes.Buffer
+				_ = binary.Write(&closing, binary.BigEndian, uint16(replyPreconditionFailed))
+				writeShortStr(&closing, "PRECONDITION_FAILED - inequivalent arg 'x-max-priority' for queue '"+name+"'")
+				_ = binary.Write(&closing, binary.BigEndian, uint16(classQueue))
+				_ = binary.Write(&closing, binary.BigEndian, uint16(methodDeclare))
+				err = writeMethod(conn, channel, classChannel, methodChClose, closing.Bytes())
+				break
+			}
+
+			var ok bytes.Buffer
+			writeShortStr(&ok, name)
+			_ = binary.Write(&ok, binary.BigEndian, uint32(0))
+			_ = binary.Write(&ok, binary.BigEndian, uint32(0))
+			err = writeMethod(conn, channel, classQueue, methodDeclareOk, ok.Bytes())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readMethod skips the frames that are not methods, heartbeats included.
+func readMethod(r io.Reader) (channel uint16, class uint16, method uint16, args []byte, err error) {
+	for {
+		header := make([]byte, 7)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return
+		}
+		if payload[len(payload)-1] != frameEnd {
+			err = errors.New("malformed frame")
+			return
+		}
+		if header[0] != frameMethod {
+			continue
+		}
+		channel = binary.BigEndian.Uint16(header[1:])
+		class = binary.BigEndian.Uint16(payload)
+		method = binary.BigEndian.Uint16(payload[2:])
+		args = payload[4 : len(payload)-1]
+		return
+	}
+}
+
+func writeMethod(w io.Writer, channel uint16, class uint16, method uint16, args []byte) error {
+	var frame bytes.Buffer
+	frame.WriteByte(frameMethod)
+	_ = binary.Write(&frame, binary.BigEndian, channel)
+	_ = binary.Write(&frame, binary.BigEndian, uint32(4+len(args)))
+	_ = binary.Write(&frame, binary.BigEndian, class)
+	_ = binary.Write(&frame, binary.BigEndian, method)
+	frame.Write(args)
+	frame.WriteByte(frameEnd)
+
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+func writeShortStr(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
+
+func writeLongStr(buf *bytes.Buffer, s string) {
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func writeTable(buf *bytes.Buffer) {
+	_ = binary.Write(buf, binary.BigEndian, uint32(0))
+}
@@ -0,0 +1,111 @@
+package rabbitmq
+
+import (
+	"bitrix-converter/internal/lib/queue"
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+const (
+	confirmPoolSize = 8
+	confirmTimeout  = 5 * time.Second
+)
+
+var (
+	ErrUnroutable = queue.ErrUnroutable
+	ErrNacked     = errors.New("message is not acknowledged by the broker")
+)
+
+// confirmChannel is a channel in confirm mode. It is used by one publisher at a time,
+// so a return received before the ack belongs to the message just published.
+type confirmChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+func (r *Rabbit) acquireConfirmChannel() (*confirmChannel, error) {
+	for {
+		select {
+		case cc := <-r.confirms:
+			if cc.ch.IsClosed() {
+				continue
+			}
+			return cc, nil
+		default:
+		}
+		break
+	}
+
+	ch, err := r.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: [%w]", err)
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, fmt.Errorf("failed to put channel into confirm mode: [%w]", err)
+	}
+	return &confirmChannel{
+		ch:      ch,
+		returns: ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// releaseConfirmChannel returns the channel to the pool. A channel that may still
+// have a confirm in flight is closed, its late ack or return must not reach the next publisher.
+func (r *Rabbit) releaseConfirmChannel(cc *confirmChannel, err error) {
+	if cc.ch.IsClosed() || (err != nil && !errors.Is(err, ErrUnroutable) && !errors.Is(err, ErrNacked)) {
+		_ = cc.ch.Close()
+		return
+	}
+	select {
+	case r.confirms <- cc:
+	default:
+		_ = cc.ch.Close()
+	}
+}
+
+// PublishMessage publishes a prepared message as mandatory and returns after the broker confirmed it.
+// A message for a queue that does not exist fails with ErrUnroutable, a nack with ErrNacked.
+func (r *Rabbit) PublishMessage(ctx context.Context, queue string, msg amqp.Publishing) (err error) {
+	cc, err := r.acquireConfirmChannel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.releaseConfirmChannel(cc, err)
+	}()
+
+	return r.publishConfirmed(ctx, cc, queue, msg)
+}
+
+// publishConfirmed publishes a mandatory message and waits until the broker confirms it.
+func (r *Rabbit) publishConfirmed(ctx context.Context, cc *confirmChannel, queue string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+
+	dc, err := cc.ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, true, false, msg)
+	if err != nil {
+		return fmt.Errorf("failed to publish message: [%w]", err)
+	}
+
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for publisher confirm: [%w]", err)
+	}
+
+	select {
+	case ret, ok := <-cc.returns:
+		if ok {
+			return fmt.Errorf("%w: queue [%s] %s", ErrUnroutable, queue, ret.ReplyText)
+		}
+	default:
+	}
+
+	if !acked {
+		return ErrNacked
+	}
+	return nil
+}
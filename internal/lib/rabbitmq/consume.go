@@ -0,0 +1,107 @@
+package rabbitmq
+
+import (
+	"bitrix-converter/internal/lib/queue"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+var _ queue.Queue = (*Rabbit)(nil)
+
+// delivery settles a message on the channel it was delivered by.
+type delivery struct {
+	d amqp.Delivery
+}
+
+func (a delivery) Ack(queue.Message) error {
+	return a.d.Ack(false)
+}
+
+func (a delivery) Reject(queue.Message) error {
+	return a.d.Reject(false)
+}
+
+func (a delivery) Requeue(queue.Message) error {
+	return a.d.Nack(false, true)
+}
+
+// Consume opens a channel for the queue. cancel closes it, so unacknowledged messages return to the queue.
+func (r *Rabbit) Consume(name string, opts queue.ConsumeOptions) (<-chan queue.Message, func(), error) {
+	ch, err := r.Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open channel: [%w]", err)
+	}
+
+	if opts.Prefetch > 0 {
+		if err = ch.Qos(opts.Prefetch, 0, false); err != nil {
+			_ = ch.Close()
+			return nil, nil, fmt.Errorf("failed to set prefetch: [%w]", err)
+		}
+	}
+
+	if opts.DeadLetter {
+		err = r.InitQueue(ch, name)
+	} else {
+		err = r.DeclareQueue(ch, name)
+	}
+	if err != nil {
+		_ = ch.Close()
+		return nil, nil, err
+	}
+
+	deliveries, err := ch.Consume(
+		name,
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		_ = ch.Close()
+		return nil, nil, fmt.Errorf("failed to consume queue: [%w]", err)
+	}
+
+	msgs := make(chan queue.Message)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(msgs)
+		for d := range deliveries {
+			select {
+			case msgs <- message(name, d):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			_ = ch.Close()
+		})
+	}
+	return msgs, cancel, nil
+}
+
+func message(name string, d amqp.Delivery) queue.Message {
+	headers := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		if s, ok := v.(string); ok {
+			headers[k] = s
+		}
+	}
+
+	return queue.Message{
+		Queue:        name,
+		Body:         d.Body,
+		Headers:      headers,
+		Priority:     d.Priority,
+		Retries:      RetryCount(d.Headers),
+		Acknowledger: delivery{d: d},
+	}
+}
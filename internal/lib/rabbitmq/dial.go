@@ -0,0 +1,97 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultLocale = "en_US"
+
+// urls returns the broker addresses in the order they are tried. RABBITMQ_URL takes precedence
+// over the separate settings, hosts without a port get RABBITMQ_PORT.
+func (r *Rabbit) urls() ([]string, error) {
+	if len(r.cfg.URL) > 0 {
+		return r.cfg.URL, nil
+	}
+	if len(r.cfg.Hosts) == 0 {
+		return nil, errors.New("neither RABBITMQ_URL nor RABBITMQ_HOST is set")
+	}
+
+	scheme := "amqp"
+	if r.cfg.TLS {
+		scheme = "amqps"
+	}
+
+	urls := make([]string, 0, len(r.cfg.Hosts))
+	for _, host := range r.cfg.Hosts {
+		host = strings.TrimSpace(host)
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, r.cfg.Port)
+		}
+		u := url.URL{Scheme: scheme, Host: host}
+		if r.cfg.User != "" {
+			u.User = url.UserPassword(r.cfg.User, r.cfg.Password)
+		}
+		urls = append(urls, u.String())
+	}
+	return urls, nil
+}
+
+func (r *Rabbit) dialConfig() (amqp.Config, error) {
+	props := amqp.NewConnectionProperties()
+	props.SetClientConnectionName(r.cfg.ConnectionName)
+
+	cfg := amqp.Config{
+		Heartbeat:  r.cfg.Heartbeat,
+		Properties: props,
+		Locale:     defaultLocale,
+	}
+	if len(r.cfg.URL) == 0 {
+		cfg.Vhost = r.cfg.Vhost
+	}
+
+	if r.cfg.CACert == "" && r.cfg.ClientCert == "" {
+		return cfg, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if r.cfg.CACert != "" {
+		pem, err := os.ReadFile(r.cfg.CACert)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read CA certificate [%s]: [%w]", r.cfg.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return cfg, fmt.Errorf("no certificates in [%s]", r.cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if r.cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(r.cfg.ClientCert, r.cfg.ClientKey)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to load client certificate [%s]: [%w]", r.cfg.ClientCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	cfg.TLSClientConfig = tlsConfig
+	return cfg, nil
+}
+
+// redact hides the password of the broker url for logs and errors.
+func redact(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "invalid url"
+	}
+	return u.Redacted()
+}
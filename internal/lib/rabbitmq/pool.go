@@ -0,0 +1,55 @@
+package rabbitmq
+
+import (
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const channelPoolSize = 4
+
+// acquireChannel takes an idle channel for short operations or opens a new one.
+// Channels closed by a failed operation or a lost connection are dropped.
+func (r *Rabbit) acquireChannel() (*amqp.Channel, error) {
+	for {
+		select {
+		case ch := <-r.channels:
+			if ch.IsClosed() {
+				continue
+			}
+			return ch, nil
+		default:
+		}
+		break
+	}
+
+	ch, err := r.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: [%w]", err)
+	}
+	return ch, nil
+}
+
+func (r *Rabbit) releaseChannel(ch *amqp.Channel) {
+	if ch.IsClosed() {
+		return
+	}
+	select {
+	case r.channels <- ch:
+	default:
+		_ = ch.Close()
+	}
+}
+
+// drainPools closes the idle channels, after a reconnect they belong to the old connection.
+func (r *Rabbit) drainPools() {
+	for {
+		select {
+		case ch := <-r.channels:
+			_ = ch.Close()
+		case cc := <-r.confirms:
+			_ = cc.ch.Close()
+		default:
+			return
+		}
+	}
+}
@@ -3,23 +3,56 @@ package rabbitmq
 import (
 	"bitrix-converter/internal/config"
 	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/tracing"
 	"context"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"maps"
+	"sync"
 	"time"
 )
 
+// reconnectDelay is the pause between failed reconnect attempts.
+const reconnectDelay = 10 * time.Second
+
+var (
+	ErrNotConnected = errors.New("rabbitmq is not connected")
+	ErrClosed       = errors.New("rabbitmq client is closed")
+)
+
+// Rabbit owns the broker connection. The connection is replaced by Reconnect,
+// so it is only read under mu; users that hold channels subscribe with NotifyReconnect.
 type Rabbit struct {
-	conn *amqp.Connection
-	log  *slog.Logger
-	cfg  config.RabbitConfig
+	mu          sync.RWMutex
+	conn        *amqp.Connection
+	next        int
+	closed      bool
+	done        chan struct{}
+	log         *slog.Logger
+	cfg         config.RabbitConfig
+	maxPriority uint8
+	confirms    chan *confirmChannel
+	channels    chan *amqp.Channel
+	topology    map[string]func(ch *amqp.Channel) error
+	subscribers map[chan struct{}]struct{}
 }
 
-func New(log *slog.Logger, cfg config.RabbitConfig) *Rabbit {
+// New creates the broker client, task queues are declared with x-max-priority of maxPriority.
+func New(log *slog.Logger, cfg config.RabbitConfig, maxPriority uint8) *Rabbit {
 	return &Rabbit{
-		log: log,
-		cfg: cfg,
+		log:         log,
+		cfg:         cfg,
+		maxPriority: maxPriority,
+		confirms:    make(chan *confirmChannel, confirmPoolSize),
+		channels:    make(chan *amqp.Channel, channelPoolSize),
+		topology:    make(map[string]func(ch *amqp.Channel) error),
+		subscribers: make(map[chan struct{}]struct{}),
+		done:        make(chan struct{}),
 	}
 }
 
@@ -27,25 +60,92 @@ func (r *Rabbit) DefaultQueue() string {
 	return r.cfg.DefaultQueue
 }
 
+// Connect dials the configured brokers in turn. After a connection is lost the next
+// broker is tried first, the one that failed is tried last. A connection made after Close is discarded.
 func (r *Rabbit) Connect() error {
-	url := fmt.Sprintf("amqp://%s:%s@%s:%s", r.cfg.User, r.cfg.Password, r.cfg.Host, r.cfg.Port)
-
-	conn, err := amqp.Dial(url)
+	urls, err := r.urls()
+	if err != nil {
+		return err
+	}
+	cfg, err := r.dialConfig()
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: [%w]", err)
+		return err
 	}
 
-	r.conn = conn
-	return nil
+	r.mu.RLock()
+	next := r.next
+	r.mu.RUnlock()
+
+	var errs []error
+	for i := range urls {
+		idx := (next + i) % len(urls)
+
+		dialCfg := cfg
+		if cfg.TLSClientConfig != nil {
+			// amqp sets ServerName to the host it dials
+			dialCfg.TLSClientConfig = cfg.TLSClientConfig.Clone()
+		}
+
+		conn, err := amqp.DialConfig(urls[idx], dialCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("[%s]: [%w]", redact(urls[idx]), err))
+			continue
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			_ = conn.Close()
+			return ErrClosed
+		}
+		r.conn = conn
+		r.next = (idx + 1) % len(urls)
+		r.mu.Unlock()
+
+		r.log.Info("connected to rabbitMQ", slog.String("url", redact(urls[idx])))
+		return nil
+	}
+	return fmt.Errorf("failed to connect to RabbitMQ: [%w]", errors.Join(errs...))
 }
 
 func (r *Rabbit) Channel() (*amqp.Channel, error) {
-	return r.conn.Channel()
+	r.mu.RLock()
+	conn := r.conn
+	r.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
 }
 
+// NotifyReconnect registers c to receive a value after every successful reconnect,
+// when the queues are already declared again. The send does not block, so a buffered
+// channel of one is enough. cancel removes the subscription.
+func (r *Rabbit) NotifyReconnect(c chan struct{}) (cancel func()) {
+	r.mu.Lock()
+	r.subscribers[c] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.subscribers, c)
+		r.mu.Unlock()
+	}
+}
+
+// Reconnect waits for the connection to close and dials again until it succeeds.
+// It returns after Close.
 func (r *Rabbit) Reconnect() {
 	for {
-		_, ok := <-r.conn.NotifyClose(make(chan *amqp.Error))
+		r.mu.RLock()
+		conn := r.conn
+		r.mu.RUnlock()
+
+		_, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		if r.isClosed() {
+			return
+		}
 		if !ok {
 			r.log.Error("failed notifying rabbitMQ channel. Reconnecting...")
 		}
@@ -56,18 +156,119 @@ func (r *Rabbit) Reconnect() {
 			err := r.Connect()
 
 			if err == nil {
+				metrics.RabbitReconnects.Inc()
 				r.log.Info("rabbitMQ reconnect success")
 				break
 			}
+			if errors.Is(err, ErrClosed) {
+				return
+			}
 
 			r.log.Error("rabbitmq reconnect failed. Retry after 10 seconds", sl.Err(err))
-			time.Sleep(10 * time.Second)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(reconnectDelay):
+			}
 		}
 
+		r.drainPools()
+		r.redeclare()
+		r.notifyReconnect()
+	}
+}
+
+// Close closes the connection and stops Reconnect.
+func (r *Rabbit) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
 	}
+	conn := r.conn
+	r.mu.Unlock()
+
+	r.drainPools()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (r *Rabbit) isClosed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.closed
+}
+
+// redeclare restores the queues declared through the old connection,
+// a broker restart loses the ones that were not durable or were deleted meanwhile.
+func (r *Rabbit) redeclare() {
+	r.mu.RLock()
+	topology := maps.Clone(r.topology)
+	r.mu.RUnlock()
+
+	if len(topology) == 0 {
+		return
+	}
+
+	ch, err := r.Channel()
+	if err != nil {
+		r.log.Error("failed to open channel to redeclare queues", sl.Err(err))
+		return
+	}
+	defer ch.Close()
+
+	for queue, declare := range topology {
+		if err = declare(ch); err != nil {
+			r.log.Error("failed to redeclare queue", slog.String("queue", queue), sl.Err(err))
+			return
+		}
+	}
+}
+
+func (r *Rabbit) notifyReconnect() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for c := range r.subscribers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Rabbit) remember(queue string, declare func(ch *amqp.Channel) error) {
+	r.mu.Lock()
+	r.topology[queue] = declare
+	r.mu.Unlock()
+}
+
+// Declare creates the task queue and its dead-letter queue, both are declared again after a reconnect.
+func (r *Rabbit) Declare(queue string) error {
+	ch, err := r.acquireChannel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.releaseChannel(ch)
+	}()
+
+	return r.InitQueue(ch, queue)
 }
 
 func (r *Rabbit) InitQueue(ch *amqp.Channel, queue string) error {
+	if err := r.initQueue(ch, queue); err != nil {
+		return err
+	}
+	r.remember(queue, func(ch *amqp.Channel) error {
+		return r.initQueue(ch, queue)
+	})
+	return nil
+}
+
+func (r *Rabbit) initQueue(ch *amqp.Channel, queue string) error {
 
 	dlQueue := queue + "_dead"
 
@@ -86,69 +287,121 @@ func (r *Rabbit) InitQueue(ch *amqp.Channel, queue string) error {
 		return fmt.Errorf("failed to declare dead letter queue: [%w]", err)
 	}
 
+	args := amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": dlQueue,
+	}
+	if r.maxPriority > 0 {
+		args["x-max-priority"] = int32(r.maxPriority)
+	}
+
 	_, err = ch.QueueDeclare(
 		queue,
 		true,
 		false,
 		false,
 		false,
-		amqp.Table{
-			"x-dead-letter-exchange":    "",
-			"x-dead-letter-routing-key": dlQueue,
-		},
+		args,
 	)
 
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		// the arguments of an existing queue cannot change, see CONVERT_QUEUE_MAX_PRIORITY in README
+		return fmt.Errorf("queue [%s] already exists with different arguments, x-max-priority [%d] "+
+			"cannot be applied to it: delete the queue or set CONVERT_QUEUE_MAX_PRIORITY to its value: [%w]",
+			queue, r.maxPriority, err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to declare queue: [%w]", err)
 	}
 	return nil
 }
 
-func (r *Rabbit) Consume(ch *amqp.Channel, queue string) (msgs <-chan amqp.Delivery, err error) {
-	msgs, err = ch.Consume(
+func (r *Rabbit) DeclareQueue(ch *amqp.Channel, queue string) error {
+	if err := declareQueue(ch, queue); err != nil {
+		return err
+	}
+	r.remember(queue, func(ch *amqp.Channel) error {
+		return declareQueue(ch, queue)
+	})
+	return nil
+}
+
+func declareQueue(ch *amqp.Channel, queue string) error {
+	_, err := ch.QueueDeclare(
 		queue,
-		"",
-		false,
+		true,
 		false,
 		false,
 		false,
 		nil,
 	)
+
 	if err != nil {
-		return nil, fmt.Errorf("failed to consume queue: [%w]", err)
+		return fmt.Errorf("failed to declare queue [%s]: [%w]", queue, err)
 	}
-	return msgs, nil
+	return nil
 }
 
-func (r *Rabbit) Publish(queue string, message []byte) error {
-	ch, err := r.Channel()
+// QueueLength returns the number of messages ready for delivery in the queue.
+func (r *Rabbit) QueueLength(queue string) (n int, err error) {
+	ch, err := r.acquireChannel()
 	if err != nil {
-		return fmt.Errorf("failed to open channel: [%w]", err)
+		return 0, err
 	}
+	defer func() {
+		r.releaseChannel(ch)
+	}()
 
-	defer ch.Close()
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect queue [%s]: [%w]", queue, err)
+	}
+	return q.Messages, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Publish sends a persistent message to the queue and returns after the broker confirmed it.
+// A message for a queue that does not exist fails with ErrUnroutable.
+func (r *Rabbit) Publish(ctx context.Context, queue string, message []byte) error {
+	return r.PublishPriority(ctx, queue, message, 0)
+}
 
-	err = ch.PublishWithContext(
-		ctx,
-		"",
-		queue,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        message,
-		},
-	)
+// PublishPriority is Publish with the message priority, the broker caps it at x-max-priority of the queue.
+func (r *Rabbit) PublishPriority(ctx context.Context, queue string, message []byte, priority uint8) (err error) {
+	defer func() {
+		metrics.Published.WithLabelValues(metrics.QueueLabel(queue), metrics.Result(err)).Inc()
+	}()
 
+	cc, err := r.acquireConfirmChannel()
 	if err != nil {
-		return fmt.Errorf("failed to publish message: [%w]", err)
+		return err
 	}
-	return nil
+	defer func() {
+		r.releaseConfirmChannel(cc, err)
+	}()
+
+	ctx, span := tracing.Start(ctx, "rabbitmq.Publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", queue),
+			attribute.Int("messaging.message.priority", int(priority)),
+		),
+	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return r.publishConfirmed(ctx, cc, queue, amqp.Publishing{
+		Headers:      InjectContext(ctx, nil),
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Persistent,
+		Priority:     priority,
+		Body:         message,
+	})
 }
 
 func (r *Rabbit) Connection() *amqp.Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.conn
 }
@@ -0,0 +1,203 @@
+package rabbitmq
+
+import (
+	"bitrix-converter/internal/config"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reconnectTimeout = 5 * time.Second
+
+func connect(t *testing.T, b *fakeBroker) *Rabbit {
+	t.Helper()
+	return connectPriority(t, b, 0)
+}
+
+func connectPriority(t *testing.T, b *fakeBroker, maxPriority uint8) *Rabbit {
+	t.Helper()
+
+	r := New(slog.New(slog.DiscardHandler), config.RabbitConfig{URL: []string{b.url()}}, maxPriority)
+	if err := r.Connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	go r.Reconnect()
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+// dropAndWait cuts the connection and waits for the notification of the reconnect.
+func dropAndWait(t *testing.T, b *fakeBroker, r *Rabbit) {
+	t.Helper()
+
+	reconnected := make(chan struct{}, 1)
+	cancel := r.NotifyReconnect(reconnected)
+	defer cancel()
+
+	b.drop()
+
+	select {
+	case <-reconnected:
+	case <-time.After(reconnectTimeout):
+		t.Fatal("no reconnect notification")
+	}
+}
+
+func TestReconnectNotifiesSubscribers(t *testing.T) {
+	b := newFakeBroker(t)
+	r := connect(t, b)
+	old := r.Connection()
+
+	dropAndWait(t, b, r)
+
+	conn := r.Connection()
+	if conn == old || conn.IsClosed() {
+		t.Fatal("connection was not replaced by an open one")
+	}
+	if n := b.connections(); n != 2 {
+		t.Fatalf("broker got %d connections, want 2", n)
+	}
+}
+
+func TestReconnectNotifiesEverySubscriber(t *testing.T) {
+	b := newFakeBroker(t)
+	r := connect(t, b)
+
+	first := make(chan struct{}, 1)
+	defer r.NotifyReconnect(first)()
+	cancelled := make(chan struct{}, 1)
+	r.NotifyReconnect(cancelled)()
+
+	dropAndWait(t, b, r)
+
+	select {
+	case <-first:
+	default:
+		t.Fatal("subscriber was not notified")
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("cancelled subscriber was notified")
+	default:
+	}
+}
+
+func TestReconnectRedeclaresTopology(t *testing.T) {
+	b := newFakeBroker(t)
+	r := connect(t, b)
+
+	if err := r.Declare("main"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	ch, err := r.Channel()
+	if err != nil {
+		t.Fatalf("channel: %v", err)
+	}
+	if err = r.DeclareQueue(ch, "status"); err != nil {
+		t.Fatalf("declare queue: %v", err)
+	}
+	_ = ch.Close()
+
+	dropAndWait(t, b, r)
+
+	got := b.queues(2)
+	for _, queue := range []string{"main_dead", "main", "status"} {
+		if !slices.Contains(got, queue) {
+			t.Errorf("queue %q was not declared again after reconnect, declared %v", queue, got)
+		}
+	}
+}
+
+func TestChannelPoolAfterReconnect(t *testing.T) {
+	b := newFakeBroker(t)
+	r := connect(t, b)
+
+	pooled := make([]*amqp.Channel, 0, channelPoolSize)
+	for range channelPoolSize {
+		ch, err := r.acquireChannel()
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		pooled = append(pooled, ch)
+	}
+	for _, ch := range pooled {
+		r.releaseChannel(ch)
+	}
+
+	dropAndWait(t, b, r)
+
+	for range channelPoolSize + 1 {
+		ch, err := r.acquireChannel()
+		if err != nil {
+			t.Fatalf("acquire after reconnect: %v", err)
+		}
+		if ch.IsClosed() || slices.Contains(pooled, ch) {
+			t.Fatal("pool handed out a channel of the lost connection")
+		}
+		if _, err = ch.QueueDeclarePassive("main", true, false, false, false, nil); err != nil {
+			t.Fatalf("channel after reconnect is not usable: %v", err)
+		}
+	}
+}
+
+func TestDeclareExplainsInequivalentArguments(t *testing.T) {
+	b := newFakeBroker(t)
+	b.inequivalent["main"] = true
+	r := connectPriority(t, b, 5)
+
+	err := r.Declare("main")
+	if err == nil {
+		t.Fatal("declare of a queue with other arguments succeeded")
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("error does not wrap the broker error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "different arguments") || !strings.Contains(err.Error(), "CONVERT_QUEUE_MAX_PRIORITY") {
+		t.Fatalf("error does not explain the argument mismatch: %v", err)
+	}
+}
+
+func TestCloseStopsReconnectWait(t *testing.T) {
+	b := newFakeBroker(t)
+	r := New(slog.New(slog.DiscardHandler), config.RabbitConfig{URL: []string{b.url()}}, 0)
+	if err := r.Connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Reconnect()
+		close(stopped)
+	}()
+
+	// the broker is gone, so Reconnect fails and waits for the next attempt
+	b.close()
+	time.Sleep(200 * time.Millisecond)
+	_ = r.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(reconnectTimeout):
+		t.Fatal("Reconnect kept waiting after Close")
+	}
+}
+
+func TestConnectAfterClose(t *testing.T) {
+	b := newFakeBroker(t)
+	r := New(slog.New(slog.DiscardHandler), config.RabbitConfig{URL: []string{b.url()}}, 0)
+	_ = r.Close()
+
+	if err := r.Connect(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("connect after close: %v, want %v", err, ErrClosed)
+	}
+	if r.Connection() != nil {
+		t.Fatal("connection made after close was kept")
+	}
+}
@@ -0,0 +1,110 @@
+package rabbitmq
+
+import (
+	"bitrix-converter/internal/lib/metrics"
+	"bitrix-converter/internal/lib/queue"
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"maps"
+	"time"
+)
+
+const (
+	// RetryCountHeader holds the number of retries a message has already been through.
+	RetryCountHeader = "x-retry-count"
+
+	// retryQueueGrace keeps an unused delay queue past the expiry of its last message.
+	retryQueueGrace = time.Minute
+)
+
+// RetryCount reads RetryCountHeader, messages without the header were never retried.
+func RetryCount(headers amqp.Table) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	}
+	return 0
+}
+
+// RetryQueue is the delay queue of the queue for the given backoff.
+func RetryQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s_retry_%s", queue, delay)
+}
+
+// Retry publishes a copy of the message to the delay queue of its queue and increments RetryCountHeader.
+// The delay queue has no consumers: the message expires after delay and is dead-lettered back to the queue.
+// Every backoff gets its own queue, so a long delay never holds back a shorter one. The queue is declared
+// on every retry and expires once it has been unused for longer than its messages live, so queues
+// of backoffs that are no longer configured do not pile up on the broker.
+func (r *Rabbit) Retry(ctx context.Context, m queue.Message, delay time.Duration) (err error) {
+	retryQueue := RetryQueue(m.Queue, delay)
+
+	defer func() {
+		metrics.Published.WithLabelValues(metrics.RetryQueueLabel(m.Queue), metrics.Result(err)).Inc()
+	}()
+
+	cc, err := r.acquireConfirmChannel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.releaseConfirmChannel(cc, err)
+	}()
+
+	_, err = cc.ch.QueueDeclare(
+		retryQueue,
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-expires":                 (2*delay + retryQueueGrace).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": m.Queue,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare retry queue [%s]: [%w]", retryQueue, err)
+	}
+
+	// the delivery keeps the x-death history that is lost in message headers
+	headers := amqp.Table{}
+	contentType := "text/plain"
+	if d, ok := m.Acknowledger.(delivery); ok {
+		maps.Copy(headers, d.d.Headers)
+		contentType = d.d.ContentType
+	} else {
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+	}
+	headers[RetryCountHeader] = int32(m.Retries + 1)
+
+	err = r.publishConfirmed(ctx, cc, retryQueue, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		Priority:     m.Priority,
+		Body:         m.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish message to retry queue [%s]: [%w]", retryQueue, err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loadAvgFile       = "/proc/loadavg"
+	memInfoFile       = "/proc/meminfo"
+	cgroupMemMaxFile  = "/sys/fs/cgroup/memory.max"
+	cgroupMemUsedFile = "/sys/fs/cgroup/memory.current"
+	cgroupCpuMaxFile  = "/sys/fs/cgroup/cpu.max"
+	cgroupCpuStatFile = "/sys/fs/cgroup/cpu.stat"
+)
+
+type resources struct {
+	// load is the CPU load per CPU available to the container
+	load float64
+	// freeMemory is the memory available to the container in bytes
+	freeMemory int64
+}
+
+// cpuMeter measures the load of a container limited by a cgroup v2 CPU quota: the host load average
+// says nothing about the CPUs the container may use, so the load is the CPU time the cgroup used
+// since the previous reading divided by the quota.
+type cpuMeter struct {
+	usage time.Duration
+	at    time.Time
+}
+
+func (m *cpuMeter) readResources() (resources, error) {
+	load, err := m.readLoad()
+	if err != nil {
+		return resources{}, err
+	}
+
+	free, err := readFreeMemory()
+	if err != nil {
+		return resources{}, err
+	}
+
+	return resources{load: load, freeMemory: free}, nil
+}
+
+func (m *cpuMeter) readLoad() (float64, error) {
+	cpus := cpuQuota()
+	if cpus <= 0 {
+		return readLoadAvg(float64(runtime.NumCPU()))
+	}
+
+	usage, err := readCpuUsage()
+	if err != nil {
+		return readLoadAvg(cpus)
+	}
+
+	now := time.Now()
+	previous, at := m.usage, m.at
+	m.usage, m.at = usage, now
+
+	if at.IsZero() || usage < previous {
+		// the first reading has nothing to compare with
+		return readLoadAvg(cpus)
+	}
+	return float64(usage-previous) / float64(now.Sub(at)) / cpus, nil
+}
+
+// cpuQuota returns the number of CPUs allowed by the cgroup v2 quota, 0 if there is no quota.
+func cpuQuota() float64 {
+	data, err := os.ReadFile(cgroupCpuMaxFile)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// readCpuUsage returns the CPU time used by the cgroup.
+func readCpuUsage() (time.Duration, error) {
+	f, err := os.Open(cgroupCpuStatFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(usec) * time.Microsecond, nil
+		}
+	}
+	return 0, errors.New("usage_usec not found in cpu.stat")
+}
+
+// readLoadAvg returns the one-minute load average per CPU.
+func readLoadAvg(cpus float64) (float64, error) {
+	data, err := os.ReadFile(loadAvgFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read load average: [%w]", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("empty load average")
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse load average: [%w]", err)
+	}
+	return load / min(cpus, float64(runtime.NumCPU())), nil
+}
+
+// readFreeMemory returns MemAvailable, lowered to the cgroup v2 limit when the container has one.
+func readFreeMemory() (int64, error) {
+	f, err := os.Open(memInfoFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read meminfo: [%w]", err)
+	}
+	defer f.Close()
+
+	free := int64(-1)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse MemAvailable: [%w]", err)
+			}
+			free = kb * 1024
+			break
+		}
+	}
+	if free < 0 {
+		return 0, errors.New("MemAvailable not found in meminfo")
+	}
+
+	limit, errLimit := readInt(cgroupMemMaxFile)
+	used, errUsed := readInt(cgroupMemUsedFile)
+	if errLimit == nil && errUsed == nil && limit-used < free {
+		free = limit - used
+	}
+	return free, nil
+}
+
+// readInt reads a single number from a file. "max" is reported as an error.
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
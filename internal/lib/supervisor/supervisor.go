@@ -0,0 +1,208 @@
+package supervisor
+
+import (
+	"bitrix-converter/internal/config"
+	"bitrix-converter/internal/lib/logger/sl"
+	"bitrix-converter/internal/lib/queue"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Handler processes a single delivery. ctx is canceled only on shutdown,
+// stopping a worker while scaling down waits for the current message.
+type Handler func(ctx context.Context, m queue.Message, workerId string)
+
+// Supervisor runs consumers for every configured queue and keeps the number of
+// workers between the configured limits depending on backlog, CPU load and free memory.
+type Supervisor struct {
+	log     *slog.Logger
+	queue   queue.Queue
+	cfg     config.ConsumerConfig
+	handler Handler
+	pools   []*pool
+	cpu     cpuMeter
+	wg      sync.WaitGroup
+}
+
+const defaultScaleInterval = 30 * time.Second
+
+type pool struct {
+	queue    string
+	min      int
+	max      int
+	prefetch int
+	nextId   int
+	workers  []*worker
+}
+
+type worker struct {
+	id     string
+	cancel context.CancelFunc
+}
+
+func New(log *slog.Logger, q queue.Queue, cfg config.ConsumerConfig, handler Handler) *Supervisor {
+	s := &Supervisor{
+		log:     log.With(slog.String("component", "supervisor")),
+		queue:   q,
+		cfg:     cfg,
+		handler: handler,
+	}
+
+	if s.cfg.ScaleInterval <= 0 {
+		s.log.Warn("invalid scale interval, use default",
+			slog.Duration("scale_interval", cfg.ScaleInterval),
+			slog.Duration("default", defaultScaleInterval))
+		s.cfg.ScaleInterval = defaultScaleInterval
+	}
+
+	for _, queue := range slices.Sorted(maps.Keys(cfg.Workers)) {
+		p := &pool{
+			queue:    queue,
+			max:      max(cfg.Workers[queue], 1),
+			min:      cfg.MinWorkers[queue],
+			prefetch: cfg.Prefetch[queue],
+		}
+		p.min = min(max(p.min, 1), p.max)
+		if p.prefetch <= 0 {
+			p.prefetch = 1
+		}
+		s.pools = append(s.pools, p)
+	}
+	return s
+}
+
+// Run starts the minimal number of workers and scales them until ctx is canceled.
+// It returns after every worker has stopped.
+func (s *Supervisor) Run(ctx context.Context) {
+	for _, p := range s.pools {
+		for len(p.workers) < p.min {
+			s.startWorker(ctx, p)
+		}
+	}
+
+	ticker := time.NewTicker(s.cfg.ScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+			s.scale(ctx)
+		}
+	}
+}
+
+func (s *Supervisor) scale(ctx context.Context) {
+	res, err := s.cpu.readResources()
+	pressure := false
+	if err != nil {
+		s.log.Debug("resource usage is unknown", sl.Err(err))
+	} else {
+		pressure = res.load > s.cfg.MaxLoad || res.freeMemory < s.cfg.MinFreeMemory
+	}
+
+	for _, p := range s.pools {
+		backlog, err := s.queue.QueueLength(p.queue)
+		if err != nil {
+			s.log.Error("failed to get queue length", slog.String("queue", p.queue), sl.Err(err))
+			continue
+		}
+
+		switch {
+		case (pressure || backlog == 0) && len(p.workers) > p.min:
+			s.stopWorker(p)
+		case !pressure && backlog > 0 && len(p.workers) < p.max:
+			s.startWorker(ctx, p)
+		default:
+			continue
+		}
+
+		s.log.Info("scaled consumers",
+			slog.String("queue", p.queue),
+			slog.Int("workers", len(p.workers)),
+			slog.Int("backlog", backlog),
+			slog.Float64("load", res.load),
+			slog.Int64("free_memory", res.freeMemory))
+	}
+}
+
+func (s *Supervisor) startWorker(ctx context.Context, p *pool) {
+	p.nextId++
+	workerCtx, cancel := context.WithCancel(ctx)
+	w := &worker{
+		id:     fmt.Sprintf("%s_%d", p.queue, p.nextId),
+		cancel: cancel,
+	}
+	p.workers = append(p.workers, w)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.work(ctx, workerCtx, p, w.id)
+	}()
+}
+
+func (s *Supervisor) stopWorker(p *pool) {
+	w := p.workers[len(p.workers)-1]
+	p.workers = p.workers[:len(p.workers)-1]
+	w.cancel()
+}
+
+// work consumes the queue until workerCtx is canceled, reopening the channel when it closes.
+// After a failure it resumes as soon as the connection is restored or after ReconnectDelay.
+func (s *Supervisor) work(ctx context.Context, workerCtx context.Context, p *pool, id string) {
+	log := s.log.With(slog.String("queue", p.queue), slog.String("worker", id))
+	log.Info("start consumer")
+
+	reconnected := make(chan struct{}, 1)
+	unsubscribe := s.queue.NotifyReconnect(reconnected)
+	defer unsubscribe()
+
+	for {
+		err := s.consume(ctx, workerCtx, p, id)
+		if workerCtx.Err() != nil {
+			log.Info("consumer stopped")
+			return
+		}
+		log.Error("consumer failed. Retry", slog.Duration("delay", s.cfg.ReconnectDelay), sl.Err(err))
+
+		select {
+		case <-workerCtx.Done():
+			log.Info("consumer stopped")
+			return
+		case <-reconnected:
+		case <-time.After(s.cfg.ReconnectDelay):
+		}
+	}
+}
+
+func (s *Supervisor) consume(ctx context.Context, workerCtx context.Context, p *pool, id string) error {
+	msgs, cancel, err := s.queue.Consume(p.queue, queue.ConsumeOptions{
+		Prefetch:   p.prefetch,
+		DeadLetter: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for {
+		select {
+		case <-workerCtx.Done():
+			return nil
+		case m, ok := <-msgs:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			s.handler(ctx, m, id)
+		}
+	}
+}
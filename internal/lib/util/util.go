@@ -8,3 +8,27 @@ func FileNameNotExt(fileName string) string {
 	}
 	return fileName
 }
+
+// FixInvalidUrlEscapes escapes percent signs that do not start a valid escape sequence,
+// so links produced by portals can be parsed.
+func FixInvalidUrlEscapes(u string) string {
+	var sb strings.Builder
+	for i := 0; i < len(u); i++ {
+		if u[i] == '%' {
+			if i+2 < len(u) && isHex(u[i+1]) && isHex(u[i+2]) {
+				sb.WriteByte(u[i])
+			} else {
+				sb.WriteString("%25")
+			}
+		} else {
+			sb.WriteByte(u[i])
+		}
+	}
+	return sb.String()
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') ||
+		(b >= 'a' && b <= 'f') ||
+		(b >= 'A' && b <= 'F')
+}
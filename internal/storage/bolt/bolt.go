@@ -0,0 +1,143 @@
+package bolt
+
+import (
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/storage"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	jobsBucket = []byte("jobs")
+)
+
+// Storage keeps jobs in a single BoltDB file, so history survives restarts.
+type Storage struct {
+	db *bolt.DB
+}
+
+func New(storagePath string) (*Storage, error) {
+	const op = "storage.bolt.New"
+
+	if err := os.MkdirAll(filepath.Dir(storagePath), 0755); err != nil {
+		return nil, fmt.Errorf("%s: [%w]", op, err)
+	}
+
+	db, err := bolt.Open(storagePath, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: [%w]", op, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: create bucket: [%w]", op, err)
+	}
+
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) SaveJob(job jobs.Job) error {
+	const op = "storage.bolt.SaveJob"
+
+	value, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("%s: [%w]", op, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), value)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: [%w]", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) Job(id string) (jobs.Job, error) {
+	const op = "storage.bolt.Job"
+
+	var job jobs.Job
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(jobsBucket).Get([]byte(id))
+		if value == nil {
+			return storage.ErrJobNotFound
+		}
+		return json.Unmarshal(value, &job)
+	})
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("%s: [%w]", op, err)
+	}
+	return job, nil
+}
+
+func (s *Storage) Jobs(q storage.Query) ([]jobs.Job, error) {
+	const op = "storage.bolt.Jobs"
+
+	result := make([]jobs.Job, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job jobs.Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("decode job [%s]: [%w]", k, err)
+			}
+			if job.Matches(q) {
+				result = append(result, job)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: [%w]", op, err)
+	}
+	return jobs.Page(result, q.Limit), nil
+}
+
+// DeleteJobs removes jobs that have not changed since before.
+func (s *Storage) DeleteJobs(before time.Time) (int, error) {
+	const op = "storage.bolt.DeleteJobs"
+
+	deleted := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		var keys [][]byte
+
+		err := b.ForEach(func(k, v []byte) error {
+			var job jobs.Job
+			if err := json.Unmarshal(v, &job); err != nil || job.UpdatedAt.Before(before) {
+				keys = append(keys, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("%s: [%w]", op, err)
+	}
+	return deleted, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
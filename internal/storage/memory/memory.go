@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"bitrix-converter/internal/lib/jobs"
+	"bitrix-converter/internal/storage"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Storage keeps jobs in process memory. History is lost on restart.
+type Storage struct {
+	mu   sync.RWMutex
+	jobs map[string]jobs.Job
+}
+
+func New() *Storage {
+	return &Storage{
+		jobs: make(map[string]jobs.Job),
+	}
+}
+
+func (s *Storage) SaveJob(job jobs.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *Storage) Job(id string) (jobs.Job, error) {
+	const op = "storage.memory.Job"
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return jobs.Job{}, fmt.Errorf("%s: [%w]", op, storage.ErrJobNotFound)
+	}
+	return job, nil
+}
+
+func (s *Storage) Jobs(q storage.Query) ([]jobs.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]jobs.Job, 0)
+	for _, job := range s.jobs {
+		if job.Matches(q) {
+			result = append(result, job)
+		}
+	}
+	return jobs.Page(result, q.Limit), nil
+}
+
+func (s *Storage) DeleteJobs(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for id, job := range s.jobs {
+		if job.UpdatedAt.Before(before) {
+			delete(s.jobs, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
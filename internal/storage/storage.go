@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Store persists jobs of type J between producer restarts.
+type Store[J any] interface {
+	SaveJob(job J) error
+	Job(id string) (J, error)
+	// Jobs returns a page of jobs matching the query, newest first.
+	Jobs(q Query) ([]J, error)
+	DeleteJobs(before time.Time) (int, error)
+	Close() error
+}
+
+// Query selects a page of jobs. An empty Status matches any job, a Limit of 0 returns all of them.
+// After continues the listing from the last job of the previous page.
+type Query struct {
+	Status string
+	Limit  int
+	After  Cursor
+}
+
+// Cursor is the position of a job in the listing: jobs are ordered by creation time, then by id.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c Cursor) IsZero() bool {
+	return c.CreatedAt.IsZero() && c.ID == ""
+}
+
+// Follows reports whether the job comes after the cursor in a newest first listing.
+// Every job follows the zero cursor.
+func (c Cursor) Follows(createdAt time.Time, id string) bool {
+	if c.IsZero() {
+		return true
+	}
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.Before(c.CreatedAt)
+	}
+	return id < c.ID
+}
+
+// Compare orders jobs newest first.
+func Compare(a Cursor, b Cursor) int {
+	if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+		return c
+	}
+	return strings.Compare(b.ID, a.ID)
+}
+
+// String encodes the cursor for an URL, ParseCursor decodes it.
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID))
+}
+
+func ParseCursor(value string) (Cursor, error) {
+	if value == "" {
+		return Cursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: [%w]", ErrInvalidCursor, err)
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return Cursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: [%w]", ErrInvalidCursor, err)
+	}
+	return Cursor{CreatedAt: time.Unix(0, n), ID: id}, nil
+}